@@ -3,14 +3,18 @@ package geoauth
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/benkim0414/geoauth/internal"
 )
 
-// URL is the GEO authentication endpoint URL.
-const URL = "https://api.geocreation.com.au/api/session/login"
+// URL is the GEO authentication endpoint URL, the AuthURL of the
+// Production environment.
+const URL = "https://api.geocreation.com.au" + loginPath
 
 type Config struct {
 	// ClientID is the application's ID.
@@ -18,37 +22,179 @@ type Config struct {
 	// ClientSecret is the application's secret.
 	ClientSecret string
 	// AuthURL is the resource server's authorization endpoint URL.
+	// If empty, the AuthURL of Environment is used.
 	AuthURL string
+
+	// Environment is the GEO environment to log in to when AuthURL is
+	// empty. If empty, Production is used.
+	Environment Environment
+
+	// AllowInsecureLocalhost permits Validate to accept a plain http
+	// login URL on localhost or a loopback address, such as that of the
+	// Local environment.
+	AllowInsecureLocalhost bool
+
+	// Strict makes TokenSource, KMSTokenSource and Client check the
+	// config with Validate. If it is invalid, the returned TokenSource or
+	// Client fails every request with the validation error instead of
+	// attempting to log in.
+	Strict bool
+
+	// EncryptedSecret reports that ClientSecret is encrypted, so that
+	// PasswordCredentialsToken, TokenSource and Client decrypt it as
+	// KMSCredentialsToken and KMSTokenSource do.
+	EncryptedSecret bool
+
+	// Decrypter converts an encrypted ClientSecret into plaintext for
+	// KMSCredentialsToken. If nil, a zero KMSProvider is used.
+	Decrypter SecretDecrypter
+
+	// Retry optionally retries logins that fail transiently.
+	// If nil, a single attempt is made.
+	Retry *RetryPolicy
+
+	// LoginFields are optional extra fields of the user object sent to
+	// the login endpoint, such as a device name. They are encoded with
+	// encoding/json and cannot override the email or password.
+	LoginFields map[string]interface{}
+
+	// ExpiryLocation is the time zone of token expiry times that the
+	// server sends without a UTC offset. If nil, UTC is used. Expiry
+	// times are also corrected for the difference between the clocks of
+	// the server, as told by its Date header, and the client.
+	ExpiryLocation *time.Location
+
+	// Clock optionally tells the time for token expiry and refreshes
+	// and for waits between login retries. If nil, the system clock
+	// is used.
+	Clock Clock
+}
+
+// A SecretDecrypter converts an encrypted client secret into its
+// plaintext form.
+type SecretDecrypter interface {
+	// DecryptSecret returns the plaintext of the encrypted secret.
+	DecryptSecret(ctx context.Context, secret string) (string, error)
+}
+
+// A SecretEncrypter converts a plaintext client secret into an
+// encrypted form that the matching SecretDecrypter understands.
+type SecretEncrypter interface {
+	// EncryptSecret returns the encrypted form of the plaintext secret.
+	EncryptSecret(ctx context.Context, plaintext string) (string, error)
+}
+
+// credentialsJSON is the format of a geo_credentials.json file.
+type credentialsJSON struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	AuthURL      string `json:"auth_url,omitempty"`
+	Environment  string `json:"environment,omitempty"`
+	SecretKMS    bool   `json:"client_secret_kms,omitempty"`
 }
 
 // ConfigFromJSON uses a geo_credentials.json file to construct a config.
+// Besides client_id and client_secret, the file may set auth_url, the
+// name of an environment, such as "local", and client_secret_kms to
+// mark the secret as encrypted, setting EncryptedSecret.
+//
+// Files with named profiles are also accepted; ConfigFromJSON reads the
+// default profile, as ConfigFromProfile(jsonKey, "") does. GEO_PROFILE
+// is not consulted.
 func ConfigFromJSON(jsonKey []byte) (*Config, error) {
-	var cred struct {
-		ClientID     string `json:"client_id"`
-		ClientSecret string `json:"client_secret"`
+	return ConfigFromProfile(jsonKey, "")
+}
+
+// configFromCredentials constructs a config from the credentials of a
+// geo_credentials.json file.
+func configFromCredentials(cred *credentialsJSON) (*Config, error) {
+	c := &Config{
+		ClientID:        cred.ClientID,
+		ClientSecret:    cred.ClientSecret,
+		AuthURL:         cred.AuthURL,
+		EncryptedSecret: cred.SecretKMS,
 	}
-	if err := json.Unmarshal(jsonKey, &cred); err != nil {
-		return nil, err
+	if cred.Environment != "" {
+		env, err := ParseEnvironment(cred.Environment)
+		if err != nil {
+			return nil, err
+		}
+		c.Environment = env
+	}
+	return c, nil
+}
+
+// authURL returns the URL of the login endpoint, defaulting to that of
+// c.Environment or Production. It is empty if c.Environment is unknown.
+func (c *Config) authURL() string {
+	if c.AuthURL != "" {
+		return c.AuthURL
+	}
+	if c.Environment != "" {
+		return c.Environment.AuthURL()
 	}
-	return &Config{
-		ClientID:     cred.ClientID,
-		ClientSecret: cred.ClientSecret,
-	}, nil
+	return URL
 }
 
-// KMSCredentialsToken converts client credentials into a token via AWS KMS.
+// WriteEncryptedJSON encrypts c.ClientSecret, which must be in plaintext,
+// with e and writes the resulting geo_credentials.json file to w.
+// The file marks the secret as encrypted, so that the Config read back
+// with ConfigFromJSON decrypts it.
+func (c *Config) WriteEncryptedJSON(ctx context.Context, w io.Writer, e SecretEncrypter) error {
+	clientSecret, err := e.EncryptSecret(ctx, c.ClientSecret)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(&credentialsJSON{
+		ClientID:     c.ClientID,
+		ClientSecret: clientSecret,
+		AuthURL:      c.AuthURL,
+		Environment:  string(c.Environment),
+		SecretKMS:    true,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// KMSCredentialsToken converts client credentials into a token,
+// decrypting the client secret with c.Decrypter (AWS KMS by default).
+// c.ClientSecret is left encrypted, so the token must be refreshed
+// through KMSTokenSource, or through Client or TokenSource of a config
+// with EncryptedSecret set. Otherwise refreshes send the encrypted
+// secret as the password.
 func (c *Config) KMSCredentialsToken(ctx context.Context) (*Token, error) {
-	clientSecret, err := internal.DecryptSecret(c.ClientSecret)
+	clientSecret, err := c.decrypter().DecryptSecret(ctx, c.ClientSecret)
 	if err != nil {
 		return nil, err
 	}
-	c.ClientSecret = clientSecret
-	return retrieveToken(ctx, c)
+	return retrieveToken(ctx, c.withSecret(clientSecret))
+}
+
+// withSecret returns a copy of c using the given plaintext client secret.
+func (c *Config) withSecret(clientSecret string) *Config {
+	c2 := *c
+	c2.ClientSecret = clientSecret
+	c2.EncryptedSecret = false
+	return &c2
+}
+
+func (c *Config) decrypter() SecretDecrypter {
+	if c.Decrypter != nil {
+		return c.Decrypter
+	}
+	return defaultKMSProvider
 }
 
 // PasswordCredentialsToken converts a resource owner email and password
-// pair into a token.
+// pair into a token. If c.EncryptedSecret is set, it is the same as
+// KMSCredentialsToken.
 func (c *Config) PasswordCredentialsToken(ctx context.Context) (*Token, error) {
+	if c.EncryptedSecret {
+		return c.KMSCredentialsToken(ctx)
+	}
 	return retrieveToken(ctx, c)
 }
 
@@ -62,15 +208,100 @@ func (c *Config) Client(ctx context.Context, t *Token) *http.Client {
 
 // TokenSource returns a TokenSource that returns t until t expires,
 // automatically refreshing it as necessary using the provided context.
+//
+// The returned TokenSource implements TokenSourceWithContext. Refreshes
+// look up values such as the HTTP client in the context of the caller
+// and then in ctx, but are not canceled when ctx is. A refresh is
+// canceled once the contexts of all the callers waiting for it are done.
+//
+// If c.EncryptedSecret is set, it is the same as KMSTokenSource.
 func (c *Config) TokenSource(ctx context.Context, t *Token) TokenSource {
+	if c.EncryptedSecret {
+		return c.KMSTokenSource(ctx, t)
+	}
+	if err := c.validateStrict(); err != nil {
+		return errorTokenSource{err}
+	}
 	tkr := &tokenRefresher{
 		ctx:  ctx,
 		conf: c,
 	}
-	return &reuseTokenSource{
-		t:   t,
-		new: tkr,
+	return newReuseTokenSource(t, tkr, c.Clock)
+}
+
+// KMSTokenSource is like TokenSource, but treats c.ClientSecret as an
+// encrypted secret which is decrypted with c.Decrypter (AWS KMS by
+// default) whenever a new token is needed. c.ClientSecret is left
+// encrypted; the plaintext is only kept inside the returned TokenSource.
+func (c *Config) KMSTokenSource(ctx context.Context, t *Token) TokenSource {
+	if err := c.validateStrict(); err != nil {
+		return errorTokenSource{err}
+	}
+	tkr := &kmsTokenRefresher{
+		ctx:  ctx,
+		conf: c,
+	}
+	return newReuseTokenSource(t, tkr, c.Clock)
+}
+
+// validateStrict validates c if c.Strict is set.
+func (c *Config) validateStrict() error {
+	if !c.Strict {
+		return nil
+	}
+	return c.Validate()
+}
+
+// kmsTokenRefresher is a TokenSource that decrypts the client secret
+// and makes HTTP requests to renew a token. It is safe for concurrent use.
+type kmsTokenRefresher struct {
+	ctx  context.Context
+	conf *Config
+
+	mu         sync.Mutex
+	ciphertext string // the ClientSecret that plaintext was decrypted from
+	plaintext  string
+}
+
+func (tf *kmsTokenRefresher) Token() (*Token, error) {
+	return tf.tokenContext(tf.ctx)
+}
+
+// TokenContext is like Token, but uses ctx for cancellation and looks
+// up context values in ctx before the context tf was created with.
+func (tf *kmsTokenRefresher) TokenContext(ctx context.Context) (*Token, error) {
+	return tf.tokenContext(withFallbackValues(ctx, tf.ctx))
+}
+
+func (tf *kmsTokenRefresher) tokenContext(ctx context.Context) (*Token, error) {
+	clientSecret, err := tf.secret(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return retrieveToken(ctx, tf.conf.withSecret(clientSecret))
+}
+
+// secret returns the decrypted client secret. The plaintext is cached
+// until tf.conf.ClientSecret changes. The secret is decrypted without
+// holding tf.mu, so that callers finding it cached do not wait for KMS.
+func (tf *kmsTokenRefresher) secret(ctx context.Context) (string, error) {
+	ciphertext := tf.conf.ClientSecret
+	tf.mu.Lock()
+	if tf.plaintext != "" && tf.ciphertext == ciphertext {
+		plaintext := tf.plaintext
+		tf.mu.Unlock()
+		return plaintext, nil
+	}
+	tf.mu.Unlock()
+
+	plaintext, err := tf.conf.decrypter().DecryptSecret(ctx, ciphertext)
+	if err != nil {
+		return "", err
 	}
+	tf.mu.Lock()
+	tf.ciphertext, tf.plaintext = ciphertext, plaintext
+	tf.mu.Unlock()
+	return plaintext, nil
 }
 
 // tokenRefresher is a TokenSource that makes HTTP requests to renew a token
@@ -87,37 +318,183 @@ func (tf *tokenRefresher) Token() (*Token, error) {
 	return tk, err
 }
 
+// TokenContext is like Token, but uses ctx for cancellation and looks
+// up context values, such as the HTTP client, in ctx before the context
+// tf was created with.
+func (tf *tokenRefresher) TokenContext(ctx context.Context) (*Token, error) {
+	return retrieveToken(withFallbackValues(ctx, tf.ctx), tf.conf)
+}
+
 // A TokenSource is anything that can return a token.
 type TokenSource interface {
 	// Token returns a token or an error.
 	Token() (*Token, error)
 }
 
+// A TokenSourceWithContext is a TokenSource that can also return a token
+// on behalf of a request carrying its own context.
+//
+// Transport uses TokenContext with the context of each outgoing request
+// when its Source implements this interface.
+type TokenSourceWithContext interface {
+	TokenSource
+
+	// TokenContext returns a token or an error, giving up when ctx
+	// is done.
+	TokenContext(ctx context.Context) (*Token, error)
+}
+
+// ContextTokenSource adapts src to a TokenSourceWithContext. If src does
+// not implement TokenSourceWithContext, the returned TokenContext only
+// checks ctx before calling src.Token.
+func ContextTokenSource(src TokenSource) TokenSourceWithContext {
+	if cs, ok := src.(TokenSourceWithContext); ok {
+		return cs
+	}
+	return contextTokenSource{src}
+}
+
+type contextTokenSource struct {
+	TokenSource
+}
+
+func (s contextTokenSource) TokenContext(ctx context.Context) (*Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Token()
+}
+
+// tokenContext returns a token from src, using ctx if src supports it.
+func tokenContext(ctx context.Context, src TokenSource) (*Token, error) {
+	return ContextTokenSource(src).TokenContext(ctx)
+}
+
 // reuseTokenSource is a TokenSource that holds a single token in memory
 // and validates its expiry before each call to retrieve it with Token.
 // If it's expired, it will be auto-refreshed using the new TokenSource.
+//
+// A valid token is read without locking. Concurrent callers that find
+// the token expired share a single call to new.Token, which runs
+// without holding any lock.
 type reuseTokenSource struct {
-	new TokenSource // called when t is expired.
+	new   TokenSource // called when t is expired.
+	clock Clock       // tells when t is expired.
+
+	t atomic.Value // *Token
 
-	mu sync.Mutex
-	t  *Token
+	mu      sync.Mutex // guards refresh and writes to t
+	refresh *refreshCall
+}
+
+// refreshCall is an in-flight or completed call to new.Token.
+type refreshCall struct {
+	done    chan struct{} // closed when t and err are set
+	t       *Token
+	err     error
+	waiters int                // callers waiting for done, guarded by mu
+	cancel  context.CancelFunc // cancels the call once no one waits
+}
+
+func newReuseTokenSource(t *Token, src TokenSource, clock Clock) *reuseTokenSource {
+	s := &reuseTokenSource{new: src, clock: clockOrSystem(clock)}
+	s.t.Store(t)
+	return s
 }
 
 // Token returns the current token if it's still valid, else will refresh
 // the current token (using r.Context for HTTP client information)
 // and return the new one.
 func (s *reuseTokenSource) Token() (*Token, error) {
+	return s.TokenContext(context.Background())
+}
+
+// TokenContext is like Token, but stops waiting for a refresh in
+// progress when ctx is done. The refresh itself carries on for the
+// benefit of other callers, and is canceled once all of its callers have
+// given up.
+func (s *reuseTokenSource) TokenContext(ctx context.Context) (*Token, error) {
+	if t := s.token(); t.validAt(s.clock.Now()) {
+		return t, nil
+	}
+	return s.replace(ctx, nil)
+}
+
+// replace fetches a token to replace old, or the cached token if old is
+// nil, unless it has already been replaced by a valid token. The fetch
+// is shared with concurrent callers of TokenContext and replace.
+func (s *reuseTokenSource) replace(ctx context.Context, old *Token) (*Token, error) {
+	s.mu.Lock()
+	if t := s.token(); t.validAt(s.clock.Now()) && t != old {
+		s.mu.Unlock()
+		return t, nil
+	}
+	c := s.refresh
+	if c == nil {
+		// The refresh is shared with other callers, so it must not be
+		// canceled when this caller alone gives up.
+		rctx, cancel := context.WithCancel(detachContext(ctx))
+		c = &refreshCall{done: make(chan struct{}), cancel: cancel}
+		s.refresh = c
+		go s.doRefresh(rctx, c)
+	}
+	c.waiters++
+	s.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.t, c.err
+	case <-ctx.Done():
+		s.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			// Later callers start a new refresh rather than join the
+			// canceled one.
+			if s.refresh == c {
+				s.refresh = nil
+			}
+		}
+		s.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// doRefresh fetches a new token for c and caches it on success.
+func (s *reuseTokenSource) doRefresh(ctx context.Context, c *refreshCall) {
+	c.t, c.err = tokenContext(ctx, s.new)
+	c.cancel()
+	s.mu.Lock()
+	if c.err == nil {
+		s.t.Store(c.t)
+	} else {
+		c.t = nil
+	}
+	if s.refresh == c {
+		s.refresh = nil
+	}
+	s.mu.Unlock()
+	close(c.done)
+}
+
+// token returns the cached token, which may be nil or expired.
+func (s *reuseTokenSource) token() *Token {
+	t, _ := s.t.Load().(*Token)
+	return t
+}
+
+// invalidate discards the cached token if it is still t, so that a token
+// that has already been replaced by a concurrent refresh is kept. Sources
+// that cache tokens themselves are told to discard t too.
+func (s *reuseTokenSource) invalidate(t *Token) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.t.Valid() {
-		return s.t, nil
+	if s.token() == t {
+		s.t.Store((*Token)(nil))
 	}
-	t, err := s.new.Token()
-	if err != nil {
-		return nil, err
+	if inv, ok := s.new.(invalidator); ok {
+		inv.invalidate(t)
 	}
-	s.t = t
-	return t, nil
 }
 
 // NewClient creates an *http.Client from a Context and TokenSource.
@@ -138,14 +515,12 @@ func NewClient(ctx context.Context, src TokenSource) *http.Client {
 // same token as long as it's valid, starting with t.
 // When its cached token is invalid, a new token is obtained from src.
 func ReuseTokenSource(t *Token, src TokenSource) TokenSource {
+	var clock Clock
 	if rt, ok := src.(*reuseTokenSource); ok {
 		if t == nil {
 			return rt
 		}
-		src = rt.new
-	}
-	return &reuseTokenSource{
-		t:   t,
-		new: src,
+		src, clock = rt.new, rt.clock
 	}
+	return newReuseTokenSource(t, src, clock)
 }
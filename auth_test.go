@@ -1,11 +1,14 @@
 package geoauth
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -36,6 +39,33 @@ func TestConfigFromJSON(t *testing.T) {
 	}
 }
 
+func TestConfigFromJSONAuthURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		jsonKey string
+		want    string
+	}{
+		{name: "default", jsonKey: `{"client_id": "CLIENT_ID"}`, want: URL},
+		{name: "auth_url", jsonKey: `{"client_id": "CLIENT_ID", "auth_url": "https://geo.example.com/login"}`, want: "https://geo.example.com/login"},
+		{name: "environment", jsonKey: `{"client_id": "CLIENT_ID", "environment": "Local"}`, want: Local.AuthURL()},
+		{name: "both", jsonKey: `{"client_id": "CLIENT_ID", "auth_url": "https://geo.example.com/login", "environment": "local"}`, want: "https://geo.example.com/login"},
+	}
+	for _, tt := range tests {
+		conf, err := ConfigFromJSON([]byte(tt.jsonKey))
+		if err != nil {
+			t.Errorf("ConfigFromJSON (%q) error = %v", tt.name, err)
+			continue
+		}
+		if got, want := conf.authURL(), tt.want; got != want {
+			t.Errorf("authURL (%q) = %q; want %q", tt.name, got, want)
+		}
+	}
+
+	if _, err := ConfigFromJSON([]byte(`{"client_id": "CLIENT_ID", "environment": "moon"}`)); err == nil {
+		t.Error("ConfigFromJSON with an unknown environment succeeded; want error")
+	}
+}
+
 func TestPasswordCredentialsTokenRequest(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
@@ -48,7 +78,7 @@ func TestPasswordCredentialsTokenRequest(t *testing.T) {
 		if err != nil {
 			t.Errorf("Failed reading request body: %s.", err)
 		}
-		expected = `{"user": {"email": "CLIENT_ID", "password": "CLIENT_SECRET"}}`
+		expected = `{"user":{"email":"CLIENT_ID","password":"CLIENT_SECRET"}}`
 		if string(body) != expected {
 			t.Errorf("res.Body = %q; wnat %q", string(body), expected)
 		}
@@ -85,7 +115,7 @@ func TestTokenRefreshRequest(t *testing.T) {
 			t.Errorf("Unexpected Content-Type header, %v is found.", headerContentType)
 		}
 		body, _ := ioutil.ReadAll(r.Body)
-		if string(body) != `{"user": {"email": "CLIENT_ID", "password": "CLIENT_SECRET"}}` {
+		if string(body) != `{"user":{"email":"CLIENT_ID","password":"CLIENT_SECRET"}}` {
 			t.Errorf("Unexpected refresh request payload, %v is found.", string(body))
 		}
 	}))
@@ -107,10 +137,13 @@ func TestTokenRetrieveError(t *testing.T) {
 	if err == nil {
 		t.Fatalf("got no error, expected one")
 	}
-	_, ok := err.(*RetrieveError)
+	rErr, ok := err.(*RetrieveError)
 	if !ok {
 		t.Fatalf("got %T error, expected *RetrieveError", err)
 	}
+	if got, want := rErr.StatusMessage, "Invalid email or password"; got != want {
+		t.Errorf("StatusMessage = %q; want %q", got, want)
+	}
 
 	expected := fmt.Sprintf("cannot fetch token: %v\nResponse: %s", "400 Bad Request", `{"statusMessage": "Invalid email or password"}`)
 	if errStr := err.Error(); errStr != expected {
@@ -141,3 +174,435 @@ func TestConfigClientWithToken(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+type fakeDecrypter map[string]string
+
+func (d fakeDecrypter) DecryptSecret(ctx context.Context, secret string) (string, error) {
+	plaintext, ok := d[secret]
+	if !ok {
+		return "", fmt.Errorf("cannot decrypt %q", secret)
+	}
+	return plaintext, nil
+}
+
+func TestKMSCredentialsTokenDecrypter(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		expected := `{"user":{"email":"CLIENT_ID","password":"PLAINTEXT"}}`
+		if string(body) != expected {
+			t.Errorf("res.Body = %q; want %q", string(body), expected)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"authenticationToken": {"token": "ACCESS_TOKEN", "expiresAt": "2018-02-01T08:37:49.3844879"}}`))
+	}))
+	defer ts.Close()
+	conf := newConf(ts.URL)
+	conf.Decrypter = fakeDecrypter{"CLIENT_SECRET": "PLAINTEXT"}
+	tok, err := conf.KMSCredentialsToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tok.AccessToken, "ACCESS_TOKEN"; got != want {
+		t.Errorf("AccessToken = %q; want %q", got, want)
+	}
+}
+
+// countingDecrypter is a fakeDecrypter that counts its calls.
+type countingDecrypter struct {
+	fakeDecrypter
+	mu    sync.Mutex
+	calls int
+}
+
+func (d *countingDecrypter) DecryptSecret(ctx context.Context, secret string) (string, error) {
+	d.mu.Lock()
+	d.calls++
+	d.mu.Unlock()
+	return d.fakeDecrypter.DecryptSecret(ctx, secret)
+}
+
+func TestKMSCredentialsTokenKeepsSecretEncrypted(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"authenticationToken": {"token": "ACCESS_TOKEN", "expiresAt": "2018-02-01T08:37:49.3844879"}}`))
+	}))
+	defer ts.Close()
+	conf := newConf(ts.URL)
+	conf.Decrypter = fakeDecrypter{"CLIENT_SECRET": "PLAINTEXT"}
+	for i := 0; i < 2; i++ {
+		if _, err := conf.KMSCredentialsToken(context.Background()); err != nil {
+			t.Fatalf("KMSCredentialsToken (call %d): %v", i+1, err)
+		}
+	}
+	if got, want := conf.ClientSecret, "CLIENT_SECRET"; got != want {
+		t.Errorf("ClientSecret = %q; want %q", got, want)
+	}
+}
+
+func TestKMSCredentialsTokenClientRefresh(t *testing.T) {
+	var logins int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/login" {
+			return
+		}
+		atomic.AddInt32(&logins, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		expected := `{"user":{"email":"CLIENT_ID","password":"PLAINTEXT"}}`
+		if string(body) != expected {
+			t.Errorf("res.Body = %q; want %q", string(body), expected)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// The expired token makes the client refresh it.
+		w.Write([]byte(`{"authenticationToken": {"token": "ACCESS_TOKEN", "expiresAt": "2018-02-01T08:37:49.3844879"}}`))
+	}))
+	defer ts.Close()
+	conf := newConf(ts.URL + "/login")
+	conf.Decrypter = fakeDecrypter{"CLIENT_SECRET": "PLAINTEXT"}
+	tok, err := conf.KMSCredentialsToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf.EncryptedSecret = true
+	c := conf.Client(context.Background(), tok)
+	res, err := c.Get(ts.URL + "/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got, want := atomic.LoadInt32(&logins), int32(2); got != want {
+		t.Errorf("logins = %d; want %d", got, want)
+	}
+}
+
+func TestKMSTokenSource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		expected := `{"user":{"email":"CLIENT_ID","password":"PLAINTEXT"}}`
+		if string(body) != expected {
+			t.Errorf("res.Body = %q; want %q", string(body), expected)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// An expired token makes every call to Token refresh.
+		w.Write([]byte(`{"authenticationToken": {"token": "ACCESS_TOKEN", "expiresAt": "2018-02-01T08:37:49.3844879"}}`))
+	}))
+	defer ts.Close()
+	conf := newConf(ts.URL)
+	dec := &countingDecrypter{fakeDecrypter: fakeDecrypter{"CLIENT_SECRET": "PLAINTEXT"}}
+	conf.Decrypter = dec
+	src := conf.KMSTokenSource(context.Background(), nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := src.Token(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := conf.ClientSecret, "CLIENT_SECRET"; got != want {
+		t.Errorf("ClientSecret = %q; want %q", got, want)
+	}
+	if got, want := dec.calls, 1; got != want {
+		t.Errorf("DecryptSecret calls = %d; want %d", got, want)
+	}
+}
+
+// blockingDecrypter decrypts secrets once release is closed, or fails
+// once the context of the call is done.
+type blockingDecrypter struct {
+	started chan struct{} // receives a value as each call starts
+	release chan struct{}
+}
+
+func (d *blockingDecrypter) DecryptSecret(ctx context.Context, secret string) (string, error) {
+	d.started <- struct{}{}
+	select {
+	case <-d.release:
+		return "PLAINTEXT", nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func TestKMSTokenRefresherDecryptsWithoutLock(t *testing.T) {
+	dec := &blockingDecrypter{started: make(chan struct{}, 2), release: make(chan struct{})}
+	conf := newConf("")
+	conf.Decrypter = dec
+	tf := &kmsTokenRefresher{ctx: context.Background(), conf: conf}
+
+	go tf.secret(context.Background())
+	<-dec.started
+	defer close(dec.release)
+
+	// A slow decryption does not hold up a caller giving up on its own.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := tf.secret(ctx)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err != context.DeadlineExceeded {
+			t.Errorf("secret error = %v; want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("secret waited for a decryption in progress")
+	}
+}
+
+// fakeEncrypter "encrypts" secrets by prefixing them.
+type fakeEncrypter struct{}
+
+func (fakeEncrypter) EncryptSecret(ctx context.Context, plaintext string) (string, error) {
+	return "ENCRYPTED:" + plaintext, nil
+}
+
+func TestWriteEncryptedJSON(t *testing.T) {
+	conf := newConf("")
+	var buf bytes.Buffer
+	if err := conf.WriteEncryptedJSON(context.Background(), &buf, fakeEncrypter{}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ConfigFromJSON(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := got.ClientID, "CLIENT_ID"; got != want {
+		t.Errorf("ClientID = %q; want %q", got, want)
+	}
+	if got, want := got.ClientSecret, "ENCRYPTED:CLIENT_SECRET"; got != want {
+		t.Errorf("ClientSecret = %q; want %q", got, want)
+	}
+	if !got.EncryptedSecret {
+		t.Error("EncryptedSecret = false; want true")
+	}
+	if got, want := conf.ClientSecret, "CLIENT_SECRET"; got != want {
+		t.Errorf("original ClientSecret = %q; want %q", got, want)
+	}
+
+	conf.Environment = Local
+	buf.Reset()
+	if err := conf.WriteEncryptedJSON(context.Background(), &buf, fakeEncrypter{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ConfigFromJSON(buf.Bytes()); err != nil || got.Environment != Local {
+		t.Errorf("ConfigFromJSON = %+v, %v; want Environment %q", got, err, Local)
+	}
+}
+
+// blockingTokenSource returns a new token once release is closed and
+// counts its calls.
+type blockingTokenSource struct {
+	release chan struct{}
+	calls   int32
+}
+
+func (s *blockingTokenSource) Token() (*Token, error) {
+	n := atomic.AddInt32(&s.calls, 1)
+	<-s.release
+	return &Token{AccessToken: fmt.Sprintf("TOKEN_%d", n)}, nil
+}
+
+func TestReuseTokenSourceSharesRefresh(t *testing.T) {
+	src := &blockingTokenSource{release: make(chan struct{})}
+	rts := ReuseTokenSource(nil, src)
+
+	const n = 10
+	tokens := make(chan *Token, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			tok, err := rts.Token()
+			if err != nil {
+				t.Error(err)
+			}
+			tokens <- tok
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(src.release)
+	for i := 0; i < n; i++ {
+		if got, want := (<-tokens).AccessToken, "TOKEN_1"; got != want {
+			t.Errorf("AccessToken = %q; want %q", got, want)
+		}
+	}
+	if got, want := atomic.LoadInt32(&src.calls), int32(1); got != want {
+		t.Errorf("refreshes = %d; want %d", got, want)
+	}
+}
+
+func TestReuseTokenSourceAbandonWait(t *testing.T) {
+	arrived := make(chan struct{})
+	canceled := make(chan struct{})
+	var logins int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&logins, 1) == 1 {
+			// Hang until the client gives up, which the server notices
+			// once the body has been read.
+			ioutil.ReadAll(r.Body)
+			close(arrived)
+			<-r.Context().Done()
+			close(canceled)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(fmt.Sprintf(`{"authenticationToken": {"token": "ACCESS_TOKEN", "expiresAt": %q}}`,
+			time.Now().UTC().Add(time.Hour).Format("2006-01-02T15:04:05.999999999"))))
+	}))
+	defer ts.Close()
+	src := ContextTokenSource(newConf(ts.URL).TokenSource(context.Background(), nil))
+
+	// Give up only once the login has reached the server.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-arrived
+		cancel()
+	}()
+	if _, err := src.TokenContext(ctx); err != context.Canceled {
+		t.Fatalf("TokenContext error = %v; want %v", err, context.Canceled)
+	}
+
+	// The refresh no one waits for is canceled, and the next caller
+	// starts a new one.
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("abandoned login was not canceled")
+	}
+	tok, err := src.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tok.AccessToken, "ACCESS_TOKEN"; got != want {
+		t.Errorf("AccessToken = %q; want %q", got, want)
+	}
+	if got, want := atomic.LoadInt32(&logins), int32(2); got != want {
+		t.Errorf("logins = %d; want %d", got, want)
+	}
+}
+
+func TestReuseTokenSourceSharedRefreshOutlivesWaiter(t *testing.T) {
+	src := &blockingTokenSource{release: make(chan struct{})}
+	rts := ReuseTokenSource(nil, src).(*reuseTokenSource)
+
+	// A caller that gives up does not cancel a refresh another caller
+	// still waits for.
+	result := make(chan error, 1)
+	go func() {
+		_, err := rts.Token()
+		result <- err
+	}()
+	for atomic.LoadInt32(&src.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := rts.TokenContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("TokenContext error = %v; want %v", err, context.DeadlineExceeded)
+	}
+	close(src.release)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := atomic.LoadInt32(&src.calls), int32(1); got != want {
+		t.Errorf("refreshes = %d; want %d", got, want)
+	}
+}
+
+func TestTokenSourceWithCanceledContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(fmt.Sprintf(`{"authenticationToken": {"token": "ACCESS_TOKEN", "expiresAt": %q}}`,
+			time.Now().UTC().Add(time.Hour).Format("2006-01-02T15:04:05.999999999"))))
+	}))
+	defer ts.Close()
+	conf := newConf(ts.URL)
+
+	// Only the values of the context the TokenSource was created with
+	// are used; refreshes are bound to the caller's context instead.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	src := conf.TokenSource(ctx, nil)
+	tok, err := ContextTokenSource(src).TokenContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tok.AccessToken, "ACCESS_TOKEN"; got != want {
+		t.Errorf("AccessToken = %q; want %q", got, want)
+	}
+}
+
+func TestContextTokenSource(t *testing.T) {
+	src := ContextTokenSource(&tokenSource{token: &Token{AccessToken: "ACCESS_TOKEN"}})
+	if _, err := src.TokenContext(context.Background()); err != nil {
+		t.Errorf("TokenContext = %v; want no error", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := src.TokenContext(ctx); err != context.Canceled {
+		t.Errorf("TokenContext (with canceled context) = %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestTokenRetrieveErrorAttempts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	conf := newConf(ts.URL)
+	conf.Retry = &RetryPolicy{MaxAttempts: 2, MinBackoff: time.Millisecond}
+	_, err := conf.PasswordCredentialsToken(context.Background())
+	rErr, ok := err.(*RetrieveError)
+	if !ok {
+		t.Fatalf("got %T error, expected *RetrieveError", err)
+	}
+	if got, want := rErr.Attempts, 2; got != want {
+		t.Errorf("Attempts = %d; want %d", got, want)
+	}
+	expected := "cannot fetch token after 2 attempts: 503 Service Unavailable\nResponse: "
+	if errStr := err.Error(); errStr != expected {
+		t.Errorf("got %#v, expected %#v", errStr, expected)
+	}
+}
+
+func TestPasswordCredentialsTokenSession(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"authenticationToken": {
+				"_id": "SESSION_ID",
+				"_type": "AuthenticationToken",
+				"token": "ACCESS_TOKEN",
+				"expiresAt": "2018-02-01T08:37:49.3844879",
+				"userId": "USER_ID",
+				"tenantId": "TENANT_ID"
+			}
+		}`))
+	}))
+	defer ts.Close()
+	tok, err := newConf(ts.URL).PasswordCredentialsToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tok.SessionID, "SESSION_ID"; got != want {
+		t.Errorf("SessionID = %q; want %q", got, want)
+	}
+	if got, want := tok.TokenType, "AuthenticationToken"; got != want {
+		t.Errorf("TokenType = %q; want %q", got, want)
+	}
+	if got, want := tok.UserID, "USER_ID"; got != want {
+		t.Errorf("UserID = %q; want %q", got, want)
+	}
+	if got, want := tok.Extra("tenantId"), "TENANT_ID"; got != want {
+		t.Errorf("Extra(tenantId) = %v; want %v", got, want)
+	}
+	if got := tok.Extra("missing"); got != nil {
+		t.Errorf("Extra(missing) = %v; want nil", got)
+	}
+}
@@ -0,0 +1,190 @@
+package geoauth
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRefreshFraction is the fraction of a token's lifetime after
+	// which BackgroundTokenSource refreshes it by default.
+	defaultRefreshFraction = 0.75
+
+	// defaultRefreshJitter is the default BackgroundOptions.Jitter.
+	defaultRefreshJitter = 0.1
+)
+
+// BackgroundOptions configures a BackgroundTokenSource.
+type BackgroundOptions struct {
+	// RefreshFraction is the fraction of a token's lifetime, between 0
+	// and 1, after which a new token is fetched in the background.
+	// If zero, 0.75 is used.
+	RefreshFraction float64
+
+	// Jitter randomly moves each refresh earlier or later by up to this
+	// fraction of the token's lifetime, so that many clients started
+	// together do not refresh together. If zero, 0.1 is used; a
+	// negative value disables jitter.
+	Jitter float64
+
+	// Clock optionally tells the time and schedules refreshes. If nil,
+	// the clock of the TokenSource given to NewBackgroundTokenSource is
+	// used if it has one, and the system clock otherwise.
+	Clock Clock
+}
+
+// BackgroundTokenSource is a TokenSource that refreshes its token in a
+// background goroutine once a fraction of the token's lifetime has
+// elapsed, serving the current token meanwhile. If a background refresh
+// fails, the current token is served until it expires and is then
+// refreshed synchronously, as with ReuseTokenSource.
+//
+// Stop must be called to release the background goroutine.
+type BackgroundTokenSource struct {
+	rts   *reuseTokenSource // caches the token and fetches new ones
+	opts  BackgroundOptions
+	clock Clock
+
+	mu      sync.Mutex
+	current *Token    // the token the next refresh is scheduled for
+	issued  time.Time // when current was first seen
+	failed  *Token    // the token whose background refresh failed
+
+	wake chan struct{} // signals that current has changed
+
+	ctx  context.Context // done once Stop is called
+	stop context.CancelFunc
+}
+
+// NewBackgroundTokenSource returns a BackgroundTokenSource that fetches
+// tokens from src. If src is a TokenSource returned by ReuseTokenSource
+// or Config.TokenSource, its cached token is used as the initial token.
+// A nil opts uses the defaults described in BackgroundOptions.
+func NewBackgroundTokenSource(src TokenSource, opts *BackgroundOptions) *BackgroundTokenSource {
+	s := &BackgroundTokenSource{wake: make(chan struct{}, 1)}
+	s.ctx, s.stop = context.WithCancel(context.Background())
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.RefreshFraction <= 0 || s.opts.RefreshFraction > 1 {
+		s.opts.RefreshFraction = defaultRefreshFraction
+	}
+	if s.opts.Jitter == 0 {
+		s.opts.Jitter = defaultRefreshJitter
+	}
+	if rt, ok := src.(*reuseTokenSource); ok {
+		s.rts = rt
+		if s.opts.Clock == nil {
+			s.opts.Clock = rt.clock
+		}
+	} else {
+		s.rts = newReuseTokenSource(nil, src, s.opts.Clock)
+	}
+	s.clock = clockOrSystem(s.opts.Clock)
+	if t := s.rts.token(); t.validAt(s.clock.Now()) {
+		s.observe(t)
+	}
+	go s.run()
+	return s
+}
+
+// Token returns the current token, fetching one synchronously if there
+// is no valid token.
+func (s *BackgroundTokenSource) Token() (*Token, error) {
+	return s.TokenContext(context.Background())
+}
+
+// TokenContext is like Token, but stops waiting for a synchronous
+// refresh when ctx is done.
+func (s *BackgroundTokenSource) TokenContext(ctx context.Context) (*Token, error) {
+	t, err := s.rts.TokenContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.observe(t)
+	return t, nil
+}
+
+// Stop stops background refreshes, canceling one in progress unless a
+// caller of Token is waiting for it. The TokenSource remains usable and
+// refreshes synchronously once the current token expires.
+func (s *BackgroundTokenSource) Stop() {
+	s.stop()
+}
+
+// invalidate discards t, which the server has rejected, so that the next
+// call to Token fetches a new token synchronously.
+func (s *BackgroundTokenSource) invalidate(t *Token) {
+	s.rts.invalidate(t)
+}
+
+// observe schedules the next refresh for t if it is a new token.
+func (s *BackgroundTokenSource) observe(t *Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t == s.current {
+		return
+	}
+	s.current, s.issued = t, s.clock.Now()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *BackgroundTokenSource) run() {
+	for {
+		s.mu.Lock()
+		t, issued, failed := s.current, s.issued, s.failed
+		s.mu.Unlock()
+
+		var due <-chan time.Time
+		stop := func() bool { return false }
+		// Tokens without an expiry, or too short-lived to be worth
+		// refreshing early, are left to the synchronous refresh.
+		if t != nil && t != failed && t.Expiry.Sub(issued) > expiryDelta {
+			due, stop = s.clock.NewTimer(s.refreshDelay(t, issued))
+		}
+		select {
+		case <-due:
+			s.refresh(t)
+		case <-s.wake:
+			stop()
+		case <-s.ctx.Done():
+			stop()
+			return
+		}
+	}
+}
+
+// refreshDelay returns how long to wait before refreshing t, which was
+// first seen at issued.
+func (s *BackgroundTokenSource) refreshDelay(t *Token, issued time.Time) time.Duration {
+	lifetime := t.Expiry.Sub(issued)
+	at := float64(lifetime) * s.opts.RefreshFraction
+	if s.opts.Jitter > 0 {
+		at += float64(lifetime) * s.opts.Jitter * (2*rand.Float64() - 1)
+	}
+	// Refresh before the token is considered expired.
+	if max := float64(lifetime - expiryDelta); at > max {
+		at = max
+	}
+	return time.Duration(at) - s.clock.Now().Sub(issued)
+}
+
+// refresh fetches a new token to replace old. The fetch is shared with
+// a synchronous refresh running at the same time.
+func (s *BackgroundTokenSource) refresh(old *Token) {
+	t, err := s.rts.replace(s.ctx, old)
+	if err != nil {
+		s.mu.Lock()
+		if s.current == old {
+			s.failed = old
+		}
+		s.mu.Unlock()
+		return
+	}
+	s.observe(t)
+}
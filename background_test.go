@@ -0,0 +1,265 @@
+package geoauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benkim0414/geoauth/geoauthtest"
+)
+
+// sequenceTokenSource returns numbered tokens with the given lifetime,
+// failing calls listed in fail.
+type sequenceTokenSource struct {
+	clock    Clock
+	lifetime time.Duration
+	fail     map[int]bool
+
+	mu    sync.Mutex
+	calls int
+	done  chan int // receives the number of each completed call
+}
+
+func newSequenceTokenSource(clock Clock, lifetime time.Duration, fail ...int) *sequenceTokenSource {
+	s := &sequenceTokenSource{
+		clock:    clock,
+		lifetime: lifetime,
+		fail:     make(map[int]bool),
+		done:     make(chan int, 10),
+	}
+	for _, n := range fail {
+		s.fail[n] = true
+	}
+	return s
+}
+
+func (s *sequenceTokenSource) Token() (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	defer func(n int) { s.done <- n }(s.calls)
+	if s.fail[s.calls] {
+		return nil, errors.New("refresh failed")
+	}
+	return &Token{
+		AccessToken: fmt.Sprintf("TOKEN_%d", s.calls),
+		Expiry:      s.clock.Now().Add(s.lifetime),
+	}, nil
+}
+
+// wait waits for the n-th call to complete.
+func (s *sequenceTokenSource) wait(t *testing.T, n int) {
+	t.Helper()
+	for {
+		select {
+		case got := <-s.done:
+			if got >= n {
+				return
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for call %d", n)
+		}
+	}
+}
+
+func assertToken(t *testing.T, src TokenSource, want string) {
+	t.Helper()
+	tok, err := src.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tok.AccessToken; got != want {
+		t.Errorf("AccessToken = %q; want %q", got, want)
+	}
+}
+
+var testBackgroundOptions = BackgroundOptions{RefreshFraction: 0.5, Jitter: -1}
+
+func newTestBackgroundTokenSource(fail ...int) (*BackgroundTokenSource, *sequenceTokenSource, *geoauthtest.FakeClock) {
+	clock := geoauthtest.NewFakeClock(time.Date(2018, 2, 1, 8, 0, 0, 0, time.UTC))
+	src := newSequenceTokenSource(clock, time.Hour, fail...)
+	opts := testBackgroundOptions
+	opts.Clock = clock
+	return NewBackgroundTokenSource(src, &opts), src, clock
+}
+
+func TestBackgroundTokenSourceRefreshesEarly(t *testing.T) {
+	bts, src, clock := newTestBackgroundTokenSource()
+	defer bts.Stop()
+
+	assertToken(t, bts, "TOKEN_1")
+	clock.BlockUntil(1)
+	clock.Advance(29 * time.Minute)
+	assertToken(t, bts, "TOKEN_1")
+
+	clock.Advance(time.Minute)
+	src.wait(t, 2)
+	clock.BlockUntil(1)
+	assertToken(t, bts, "TOKEN_2")
+}
+
+func TestBackgroundTokenSourceFailedRefresh(t *testing.T) {
+	bts, _, clock := newTestBackgroundTokenSource(2)
+	defer bts.Stop()
+
+	tok, err := bts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.BlockUntil(1)
+	clock.Advance(30 * time.Minute)
+	// Wait for the failure to be recorded rather than for the call to
+	// return, so that the refresh is over before the next Token.
+	for {
+		bts.mu.Lock()
+		failed := bts.failed
+		bts.mu.Unlock()
+		if failed == tok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assertToken(t, bts, "TOKEN_1")
+
+	// Once expired, the token is refreshed synchronously.
+	clock.Advance(30*time.Minute - expiryDelta + time.Second)
+	assertToken(t, bts, "TOKEN_3")
+}
+
+func TestBackgroundTokenSourceReschedules(t *testing.T) {
+	bts, src, clock := newTestBackgroundTokenSource()
+	defer bts.Stop()
+
+	tok, err := bts.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.BlockUntil(1)
+	// A synchronous refresh replaces the timer of the old token.
+	bts.invalidate(tok)
+	assertToken(t, bts, "TOKEN_2")
+	time.Sleep(10 * time.Millisecond)
+	if got, want := clock.Waiters(), 1; got != want {
+		t.Fatalf("Waiters = %d; want %d", got, want)
+	}
+
+	clock.Advance(30 * time.Minute)
+	src.wait(t, 3)
+	clock.BlockUntil(1)
+	assertToken(t, bts, "TOKEN_3")
+}
+
+func TestBackgroundTokenSourceStop(t *testing.T) {
+	bts, src, clock := newTestBackgroundTokenSource()
+	assertToken(t, bts, "TOKEN_1")
+	clock.BlockUntil(1)
+	bts.Stop()
+	bts.Stop()
+
+	clock.Advance(30 * time.Minute)
+	assertToken(t, bts, "TOKEN_1")
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if got, want := src.calls, 1; got != want {
+		t.Errorf("calls after Stop = %d; want %d", got, want)
+	}
+}
+
+// gatedTokenSource returns tokens with an hour's lifetime once release
+// is closed, and fails once the context of the call is done.
+type gatedTokenSource struct {
+	clock    Clock
+	release  chan struct{}
+	started  chan struct{} // receives a value as each call starts
+	canceled chan struct{} // receives a value as each call is canceled
+	calls    int32
+}
+
+func newGatedTokenSource(clock Clock) *gatedTokenSource {
+	return &gatedTokenSource{
+		clock:    clock,
+		release:  make(chan struct{}),
+		started:  make(chan struct{}, 10),
+		canceled: make(chan struct{}, 10),
+	}
+}
+
+func (s *gatedTokenSource) Token() (*Token, error) {
+	return s.TokenContext(context.Background())
+}
+
+func (s *gatedTokenSource) TokenContext(ctx context.Context) (*Token, error) {
+	n := atomic.AddInt32(&s.calls, 1)
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+		return &Token{AccessToken: fmt.Sprintf("TOKEN_%d", n), Expiry: s.clock.Now().Add(time.Hour)}, nil
+	case <-ctx.Done():
+		s.canceled <- struct{}{}
+		return nil, ctx.Err()
+	}
+}
+
+// newGatedBackgroundTokenSource returns a BackgroundTokenSource starting
+// with TOKEN_0, valid for an hour, and fetching tokens from a
+// gatedTokenSource.
+func newGatedBackgroundTokenSource(opts BackgroundOptions) (*BackgroundTokenSource, *gatedTokenSource, *geoauthtest.FakeClock) {
+	clock := geoauthtest.NewFakeClock(time.Date(2018, 2, 1, 8, 0, 0, 0, time.UTC))
+	src := newGatedTokenSource(clock)
+	tok := &Token{AccessToken: "TOKEN_0", Expiry: clock.Now().Add(time.Hour)}
+	opts.Clock = clock
+	return NewBackgroundTokenSource(newReuseTokenSource(tok, src, clock), &opts), src, clock
+}
+
+func waitFor(t *testing.T, c <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-c:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestBackgroundTokenSourceStopCancelsRefresh(t *testing.T) {
+	bts, src, clock := newGatedBackgroundTokenSource(testBackgroundOptions)
+	defer close(src.release)
+
+	clock.BlockUntil(1)
+	clock.Advance(30 * time.Minute)
+	waitFor(t, src.started, "the background refresh")
+	bts.Stop()
+	waitFor(t, src.canceled, "the background refresh to be canceled")
+}
+
+func TestBackgroundTokenSourceSharesRefresh(t *testing.T) {
+	bts, src, clock := newGatedBackgroundTokenSource(BackgroundOptions{RefreshFraction: 1, Jitter: -1})
+	defer bts.Stop()
+
+	// The background refresh is due as the token expires, when a
+	// synchronous refresh is due too.
+	clock.BlockUntil(1)
+	clock.Advance(time.Hour - expiryDelta)
+	waitFor(t, src.started, "the background refresh")
+	clock.Advance(time.Second)
+	tokens := make(chan *Token)
+	go func() {
+		tok, err := bts.Token()
+		if err != nil {
+			t.Error(err)
+		}
+		tokens <- tok
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(src.release)
+
+	if tok := <-tokens; tok == nil || tok.AccessToken != "TOKEN_1" {
+		t.Errorf("Token = %v; want TOKEN_1", tok)
+	}
+	if got, want := atomic.LoadInt32(&src.calls), int32(1); got != want {
+		t.Errorf("refreshes = %d; want %d", got, want)
+	}
+}
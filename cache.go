@@ -0,0 +1,324 @@
+package geoauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A TokenCache stores tokens outside of a TokenSource, such as on disk,
+// so that they can be reused by later processes.
+type TokenCache interface {
+	// Load returns the token stored under key. If there is none, it
+	// returns a nil token and a nil error.
+	Load(ctx context.Context, key string) (*Token, error)
+
+	// Store stores t under key, replacing any token stored before.
+	Store(ctx context.Context, key string, t *Token) error
+}
+
+// A LockingTokenCache is a TokenCache whose keys can be locked against
+// concurrent processes. CachedTokenSource holds the lock of its key from
+// finding that the cached token is missing or expired until it has
+// stored a new one, so that processes sharing the cache log in once.
+type LockingTokenCache interface {
+	TokenCache
+
+	// Lock waits for an exclusive lock on key. It returns a TokenCache
+	// through which key is loaded and stored while the lock is held,
+	// and a function releasing the lock.
+	Lock(ctx context.Context, key string) (locked TokenCache, unlock func(), err error)
+}
+
+// TokenCacheKey returns the key under which the tokens of c are cached.
+// It identifies the GEO account by its login URL and ClientID.
+func (c *Config) TokenCacheKey() string {
+	return c.authURL() + " " + c.ClientID
+}
+
+// CachedTokenSource returns a TokenSource that returns the token stored
+// in cache under key while it is valid. When it is not, a new token is
+// obtained from src and stored in cache. The token is also kept in
+// memory, as with ReuseTokenSource.
+//
+// If cache is a LockingTokenCache, the key is locked while a new token
+// is fetched, and a token stored by another process in the meantime is
+// used instead. Otherwise concurrent processes may each fetch a token.
+//
+// Errors loading or storing tokens are not returned: a token that
+// cannot be loaded is fetched from src, and a token that cannot be
+// stored is still returned.
+func CachedTokenSource(cache TokenCache, key string, src TokenSource) TokenSource {
+	var clock Clock
+	if rt, ok := src.(*reuseTokenSource); ok {
+		src, clock = rt.new, rt.clock
+	}
+	cts := &cachingTokenSource{
+		cache: cache,
+		key:   key,
+		new:   src,
+		clock: clockOrSystem(clock),
+	}
+	return newReuseTokenSource(nil, cts, clock)
+}
+
+// cachingTokenSource is a TokenSource that loads tokens from a cache
+// before fetching and storing new ones.
+type cachingTokenSource struct {
+	cache TokenCache
+	key   string
+	new   TokenSource
+	clock Clock
+
+	mu       sync.Mutex
+	rejected string // access token of the last invalidated token
+}
+
+func (s *cachingTokenSource) Token() (*Token, error) {
+	return s.TokenContext(context.Background())
+}
+
+func (s *cachingTokenSource) TokenContext(ctx context.Context) (*Token, error) {
+	s.mu.Lock()
+	rejected := s.rejected
+	s.mu.Unlock()
+
+	if t := s.load(ctx, s.cache, rejected); t != nil {
+		return t, nil
+	}
+	cache := s.cache
+	if lc, ok := cache.(LockingTokenCache); ok {
+		if locked, unlock, err := lc.Lock(ctx, s.key); err == nil {
+			defer unlock()
+			// Another process may have stored a token while we waited.
+			if t := s.load(ctx, locked, rejected); t != nil {
+				return t, nil
+			}
+			cache = locked
+		}
+	}
+	t, err := tokenContext(ctx, s.new)
+	if err != nil {
+		return nil, err
+	}
+	cache.Store(ctx, s.key, t)
+	return t, nil
+}
+
+// load returns the token stored in cache if it is valid and has not been
+// rejected, or nil otherwise.
+func (s *cachingTokenSource) load(ctx context.Context, cache TokenCache, rejected string) *Token {
+	t, err := cache.Load(ctx, s.key)
+	if err != nil || !t.validAt(s.clock.Now()) || t.AccessToken == rejected {
+		return nil
+	}
+	t.clock = s.clock
+	return t
+}
+
+// invalidate stops t from being loaded from the cache again, as the
+// server has rejected it.
+func (s *cachingTokenSource) invalidate(t *Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejected = t.AccessToken
+}
+
+// FileTokenCache is a TokenCache that stores each token in a file of
+// its own, readable only by its owner. Files are replaced atomically
+// and locked while in use where the platform supports it, so that the
+// cache can be shared by concurrent processes, which then log in once
+// through CachedTokenSource. Tokens are encoded with Token.MarshalJSON.
+type FileTokenCache struct {
+	// Dir is the directory holding the cache files. If empty, a geoauth
+	// directory in the user's cache directory is used.
+	Dir string
+
+	// Cipher optionally encrypts the tokens at rest. Each token is
+	// encrypted with AES-GCM under a random data key, which is stored
+	// alongside it encrypted with Cipher, such as a KMSProvider. The
+	// cache key is authenticated with the token, so that files cannot
+	// be swapped between keys.
+	//
+	// Files that cannot be decrypted, including tampered files and
+	// files written without encryption, are treated as missing.
+	Cipher SecretCipher
+}
+
+// Load reads the token stored under key.
+func (c *FileTokenCache) Load(ctx context.Context, key string) (*Token, error) {
+	return c.load(ctx, key, true)
+}
+
+// Store writes t under key.
+func (c *FileTokenCache) Store(ctx context.Context, key string, t *Token) error {
+	return c.store(ctx, key, t, true)
+}
+
+// Lock locks the file of key against other processes until unlock is
+// called, or returns the error of ctx if it is done first. Load and Store
+// of c wait for the lock, so the returned cache must be used instead
+// while it is held.
+func (c *FileTokenCache) Lock(ctx context.Context, key string) (locked TokenCache, unlock func(), err error) {
+	path, err := c.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, nil, err
+	}
+	if unlock, err = lockPath(ctx, path, true); err != nil {
+		return nil, nil, err
+	}
+	return lockedFileTokenCache{c}, unlock, nil
+}
+
+// lockedFileTokenCache accesses a FileTokenCache whose lock is held.
+type lockedFileTokenCache struct {
+	c *FileTokenCache
+}
+
+func (l lockedFileTokenCache) Load(ctx context.Context, key string) (*Token, error) {
+	return l.c.load(ctx, key, false)
+}
+
+func (l lockedFileTokenCache) Store(ctx context.Context, key string, t *Token) error {
+	return l.c.store(ctx, key, t, false)
+}
+
+// load reads the token stored under key, taking a shared lock if lock is
+// set.
+func (c *FileTokenCache) load(ctx context.Context, key string, lock bool) (*Token, error) {
+	path, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+	if lock {
+		// Without a lock file, as in a copied cache directory, the token
+		// file is still read: it is only ever replaced atomically.
+		unlock, err := lockPath(ctx, path, false)
+		if err == nil {
+			defer unlock()
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if c.Cipher != nil {
+		if b, err = openEnvelope(ctx, c.Cipher, b, []byte(key)); err != nil {
+			return nil, nil
+		}
+	}
+	t := new(Token)
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// store writes t under key, taking an exclusive lock if lock is set.
+func (c *FileTokenCache) store(ctx context.Context, key string, t *Token, lock bool) error {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if c.Cipher != nil {
+		if b, err = sealEnvelope(ctx, c.Cipher, b, []byte(key)); err != nil {
+			return err
+		}
+	}
+	path, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if lock {
+		unlock, err := lockPath(ctx, path, true)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	return writeFileAtomic(path, b)
+}
+
+// path returns the name of the file storing the token under key.
+func (c *FileTokenCache) path(key string) (string, error) {
+	dir := c.Dir
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(cacheDir, "geoauth")
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".json"), nil
+}
+
+// writeFileAtomic writes b to a temporary file with 0600 permissions in
+// the directory of path and renames it to path, so that readers see
+// either the old or the new contents.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// lockPath locks the lock file of path, shared or exclusive, and
+// returns a function releasing the lock. It stops waiting for the lock
+// when ctx is done. A shared lock is not taken if the lock file does not
+// exist, in which case the error satisfies os.IsNotExist.
+func lockPath(ctx context.Context, path string, exclusive bool) (unlock func(), err error) {
+	flag := os.O_RDONLY
+	if exclusive {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	f, err := os.OpenFile(path+".lock", flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(ctx, f, exclusive); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,353 @@
+package geoauth
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benkim0414/geoauth/geoauthtest"
+)
+
+func TestFileTokenCache(t *testing.T) {
+	ctx := context.Background()
+	cache := &FileTokenCache{Dir: filepath.Join(t.TempDir(), "cache")}
+
+	tok, err := cache.Load(ctx, "KEY")
+	if tok != nil || err != nil {
+		t.Fatalf("Load of a missing key = %v, %v; want nil, nil", tok, err)
+	}
+
+	want := &Token{
+		AccessToken: "ACCESS_TOKEN",
+		Expiry:      time.Date(2018, 2, 1, 9, 0, 0, 0, time.UTC),
+		SessionID:   "SESSION_ID",
+		TokenType:   "AuthenticationToken",
+		UserID:      "USER_ID",
+		raw:         newRawFields(map[string]interface{}{"deviceName": "DEVICE"}),
+	}
+	if err := cache.Store(ctx, "KEY", want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := cache.Load(ctx, "KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load = %#v; want %#v", got, want)
+	}
+	if tok, _ := cache.Load(ctx, "OTHER_KEY"); tok != nil {
+		t.Errorf("Load of another key = %#v; want nil", tok)
+	}
+
+	files, err := filepath.Glob(filepath.Join(cache.Dir, "*.json"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("cache files = %v, %v; want one file", files, err)
+	}
+	if runtime.GOOS != "windows" {
+		fi, err := os.Stat(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := fi.Mode().Perm(), os.FileMode(0600); got != want {
+			t.Errorf("cache file mode = %v; want %v", got, want)
+		}
+	}
+	b, _ := ioutil.ReadFile(files[0])
+	if err := ioutil.WriteFile(files[0], b[:len(b)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Load(ctx, "KEY"); err == nil {
+		t.Error("Load of a truncated file succeeded; want error")
+	}
+}
+
+func TestFileTokenCacheMissingLockFile(t *testing.T) {
+	ctx := context.Background()
+	cache := &FileTokenCache{Dir: t.TempDir()}
+	want := &Token{AccessToken: "ACCESS_TOKEN"}
+	if err := cache.Store(ctx, "KEY", want); err != nil {
+		t.Fatal(err)
+	}
+	locks, err := filepath.Glob(filepath.Join(cache.Dir, "*.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lock := range locks {
+		if err := os.Remove(lock); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := cache.Load(ctx, "KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.AccessToken != want.AccessToken {
+		t.Errorf("Load without a lock file = %#v; want %#v", got, want)
+	}
+}
+
+func TestCachedTokenSourceSharesTokens(t *testing.T) {
+	server := geoauthtest.NewServer()
+	defer server.Close()
+	conf := newConf(server.LoginURL)
+	cache := &FileTokenCache{Dir: t.TempDir()}
+
+	// Each source stands for a process sharing the cache.
+	first, err := CachedTokenSource(cache, conf.TokenCacheKey(), conf.TokenSource(context.Background(), nil)).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := CachedTokenSource(cache, conf.TokenCacheKey(), conf.TokenSource(context.Background(), nil)).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := second.AccessToken, first.AccessToken; got != want {
+		t.Errorf("AccessToken = %q; want the cached %q", got, want)
+	}
+	if got, want := server.LoginCount(), 1; got != want {
+		t.Errorf("LoginCount = %d; want %d", got, want)
+	}
+
+	other := newConf(server.LoginURL)
+	other.ClientID = "OTHER_CLIENT_ID"
+	if _, err := CachedTokenSource(cache, other.TokenCacheKey(), other.TokenSource(context.Background(), nil)).Token(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := server.LoginCount(), 2; got != want {
+		t.Errorf("LoginCount after another client = %d; want %d", got, want)
+	}
+}
+
+func TestCachedTokenSourceConcurrentMiss(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("cache files are not locked on " + runtime.GOOS)
+	}
+	server := geoauthtest.NewServer()
+	defer server.Close()
+	conf := newConf(server.LoginURL)
+	dir := t.TempDir()
+
+	// Each source, with a cache of its own, stands for a process finding
+	// the shared cache empty at the same time.
+	const n = 8
+	tokens := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cache := &FileTokenCache{Dir: dir}
+			tok, err := CachedTokenSource(cache, conf.TokenCacheKey(), conf.TokenSource(context.Background(), nil)).Token()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			tokens[i] = tok.AccessToken
+		}(i)
+	}
+	wg.Wait()
+	for i, tok := range tokens {
+		if tok != tokens[0] {
+			t.Errorf("tokens[%d] = %q; want %q", i, tok, tokens[0])
+		}
+	}
+	if got, want := server.LoginCount(), 1; got != want {
+		t.Errorf("LoginCount = %d; want %d", got, want)
+	}
+}
+
+func TestFileTokenCacheLockContext(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("cache files are not locked on " + runtime.GOOS)
+	}
+	dir := t.TempDir()
+	holder := &FileTokenCache{Dir: dir}
+	_, unlock, err := holder.Lock(context.Background(), "KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second process stops waiting for the lock once its context is
+	// done.
+	waiter := &FileTokenCache{Dir: dir}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := waiter.Lock(ctx, "KEY"); err != context.DeadlineExceeded {
+		t.Errorf("Lock of a held key error = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := waiter.Load(ctx, "KEY"); err != context.DeadlineExceeded {
+		t.Errorf("Load of a held key error = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	unlock()
+	_, unlock, err = waiter.Lock(context.Background(), "KEY")
+	if err != nil {
+		t.Fatalf("Lock of a released key error = %v", err)
+	}
+	unlock()
+}
+
+func TestCachedTokenSourceRefreshesExpiredToken(t *testing.T) {
+	clock := geoauthtest.NewFakeClock(time.Date(2018, 2, 1, 8, 0, 0, 0, time.UTC))
+	server := geoauthtest.NewServer()
+	defer server.Close()
+	server.SetClock(clock)
+	conf := newConf(server.LoginURL)
+	conf.Clock = clock
+	cache := &FileTokenCache{Dir: t.TempDir()}
+	key := conf.TokenCacheKey()
+
+	first, err := CachedTokenSource(cache, key, conf.TokenSource(context.Background(), nil)).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := CachedTokenSource(cache, key, conf.TokenSource(context.Background(), nil)).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := cached.AccessToken, first.AccessToken; got != want {
+		t.Errorf("AccessToken before expiry = %q; want the cached %q", got, want)
+	}
+	if got, want := server.LoginCount(), 1; got != want {
+		t.Errorf("LoginCount before expiry = %d; want %d", got, want)
+	}
+
+	clock.Advance(geoauthtest.DefaultTokenLifetime)
+	second, err := CachedTokenSource(cache, key, conf.TokenSource(context.Background(), nil)).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.AccessToken == first.AccessToken {
+		t.Error("expired cached token was reused")
+	}
+	stored, err := cache.Load(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stored.AccessToken, second.AccessToken; got != want {
+		t.Errorf("stored AccessToken = %q; want %q", got, want)
+	}
+	if got, want := server.LoginCount(), 2; got != want {
+		t.Errorf("LoginCount after expiry = %d; want %d", got, want)
+	}
+}
+
+func TestCachedTokenSourceDiscardsRevokedToken(t *testing.T) {
+	server := geoauthtest.NewServer()
+	defer server.Close()
+	conf := newConf(server.LoginURL)
+	cache := &FileTokenCache{Dir: t.TempDir()}
+	src := CachedTokenSource(cache, conf.TokenCacheKey(), conf.TokenSource(context.Background(), nil))
+
+	tok, err := src.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Revoke(tok.AccessToken)
+	res, err := NewClient(context.Background(), src).Get(server.URL + "/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got, want := res.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("StatusCode = %d; want %d", got, want)
+	}
+	stored, err := cache.Load(context.Background(), conf.TokenCacheKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.AccessToken == tok.AccessToken {
+		t.Error("revoked token is still cached")
+	}
+}
+
+func newKMSCipher(t *testing.T) *KMSProvider {
+	s := geoauthtest.NewKMSServer()
+	t.Cleanup(s.Close)
+	return &KMSProvider{
+		Endpoint:        s.URL,
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+		KeyID:           s.CreateKey(),
+	}
+}
+
+func TestFileTokenCacheEncrypted(t *testing.T) {
+	ctx := context.Background()
+	cache := &FileTokenCache{Dir: t.TempDir(), Cipher: newKMSCipher(t)}
+	want := &Token{AccessToken: "ACCESS_TOKEN", SessionID: "SESSION_ID"}
+	if err := cache.Store(ctx, "KEY", want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := cache.Load(ctx, "KEY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Load = %#v; want %#v", got, want)
+	}
+
+	path, _ := cache.path("KEY")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "ACCESS_TOKEN") {
+		t.Errorf("cache file contains the access token in plaintext: %s", b)
+	}
+}
+
+func TestFileTokenCacheEncryptedMisses(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	cache := &FileTokenCache{Dir: dir, Cipher: newKMSCipher(t)}
+	if err := cache.Store(ctx, "KEY", &Token{AccessToken: "ACCESS_TOKEN"}); err != nil {
+		t.Fatal(err)
+	}
+	path, _ := cache.path("KEY")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		t.Fatal(err)
+	}
+	env.Ciphertext[0] ^= 1
+	tampered, _ := json.Marshal(&env)
+
+	tests := []struct {
+		name  string
+		cache *FileTokenCache
+		key   string
+		data  []byte
+	}{
+		{name: "tampered", cache: cache, key: "KEY", data: tampered},
+		{name: "moved to another key", cache: cache, key: "OTHER_KEY", data: b},
+		{name: "other data key cipher", cache: &FileTokenCache{Dir: dir, Cipher: newKMSCipher(t)}, key: "KEY", data: b},
+		{name: "not encrypted", cache: cache, key: "KEY", data: []byte(`{"access_token":"ACCESS_TOKEN"}`)},
+	}
+	for _, tt := range tests {
+		if err := tt.cache.Store(ctx, tt.key, &Token{AccessToken: "OTHER"}); err != nil {
+			t.Fatal(err)
+		}
+		path, _ := tt.cache.path(tt.key)
+		if err := ioutil.WriteFile(path, tt.data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		tok, err := tt.cache.Load(ctx, tt.key)
+		if tok != nil || err != nil {
+			t.Errorf("Load (%q) = %v, %v; want nil, nil", tt.name, tok, err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package geoauth
+
+import "time"
+
+// A Clock tells the current time and signals when a duration has
+// elapsed. Token expiry, token refreshes and login retries consult a
+// Clock, so that tests can control time instead of sleeping; see
+// geoauthtest.FakeClock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer starts a timer that sends the current time on c once d
+	// has elapsed. Calling stop releases the timer and, like
+	// time.Timer.Stop, reports whether it had yet to fire.
+	NewTimer(d time.Duration) (c <-chan time.Time, stop func() bool)
+}
+
+// systemClock is the Clock backed by the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
+
+// clockOrSystem returns c, or the system clock if c is nil.
+func clockOrSystem(c Clock) Clock {
+	if c == nil {
+		return systemClock{}
+	}
+	return c
+}
@@ -0,0 +1,45 @@
+package geoauth
+
+import (
+	"context"
+	"time"
+)
+
+// detachContext returns a context carrying the values of ctx that is
+// never canceled and has no deadline.
+func detachContext(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// withFallbackValues returns ctx, but looks up values missing from ctx
+// in fallback. Cancellation and deadlines come from ctx alone.
+func withFallbackValues(ctx, fallback context.Context) context.Context {
+	if fallback == nil {
+		return ctx
+	}
+	return fallbackContext{ctx, fallback}
+}
+
+type fallbackContext struct {
+	context.Context
+	fallback context.Context
+}
+
+func (c fallbackContext) Value(key interface{}) interface{} {
+	if v := c.Context.Value(key); v != nil {
+		return v
+	}
+	return c.fallback.Value(key)
+}
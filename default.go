@@ -0,0 +1,119 @@
+package geoauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// CredentialsEnvVar is the environment variable naming the
+// geo_credentials.json file used by FindDefaultConfig.
+const CredentialsEnvVar = "GEO_APPLICATION_CREDENTIALS"
+
+// credentialsFile is the name of the credentials file in the geoauth
+// directory of the user's config directory.
+const credentialsFile = "geo_credentials.json"
+
+// ConfigSourceKind identifies a step of the FindDefaultConfig chain.
+type ConfigSourceKind int
+
+const (
+	// SourceEnv is the environment variables read by ConfigFromEnv
+	// with DefaultEnvPrefix.
+	SourceEnv ConfigSourceKind = iota + 1
+
+	// SourceCredentialsFile is the file named by CredentialsEnvVar.
+	SourceCredentialsFile
+
+	// SourceUserConfigDir is the geoauth/geo_credentials.json file in
+	// the user's config directory, as returned by os.UserConfigDir.
+	SourceUserConfigDir
+)
+
+// ConfigSource tells where FindDefaultConfig found a config.
+type ConfigSource struct {
+	Kind ConfigSourceKind
+	// Path is the credentials file the config was read from. It is
+	// empty for SourceEnv.
+	Path string
+}
+
+func (s ConfigSource) String() string {
+	switch s.Kind {
+	case SourceEnv:
+		return "environment variables " + DefaultEnvPrefix + "_*"
+	case SourceCredentialsFile:
+		return CredentialsEnvVar + " file " + s.Path
+	case SourceUserConfigDir:
+		return "user config file " + s.Path
+	}
+	return "unknown source"
+}
+
+// FindDefaultConfig looks for a config in the following places, in
+// order, and returns the first one found along with its source:
+//
+//  1. The environment variables read by ConfigFromEnv(""), if
+//     GEO_CLIENT_ID is set.
+//  2. The geo_credentials.json file named by the
+//     GEO_APPLICATION_CREDENTIALS environment variable, if set.
+//  3. The geoauth/geo_credentials.json file in the user's config
+//     directory, such as $XDG_CONFIG_HOME/geoauth/geo_credentials.json
+//     on Linux, if it exists.
+//
+// Credentials files are read with ConfigFromJSON, except that the
+// GEO_PROFILE environment variable, if set, selects the profile of a
+// file with named profiles. An error is returned if the first source
+// found cannot be used; later sources are not consulted.
+func FindDefaultConfig() (*Config, ConfigSource, error) {
+	if os.Getenv(DefaultEnvPrefix+"_CLIENT_ID") != "" {
+		c, err := ConfigFromEnv("")
+		return c, ConfigSource{Kind: SourceEnv}, err
+	}
+	if path := os.Getenv(CredentialsEnvVar); path != "" {
+		src := ConfigSource{Kind: SourceCredentialsFile, Path: path}
+		c, err := readCredentialsFile(path)
+		if err != nil {
+			return nil, src, fmt.Errorf("cannot read %s: %w", src, err)
+		}
+		return c, src, nil
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		path := filepath.Join(dir, "geoauth", credentialsFile)
+		src := ConfigSource{Kind: SourceUserConfigDir, Path: path}
+		c, err := readCredentialsFile(path)
+		if err == nil {
+			return c, src, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, src, fmt.Errorf("cannot read %s: %w", src, err)
+		}
+	}
+	return nil, ConfigSource{}, errNoDefaultConfig
+}
+
+var errNoDefaultConfig = errors.New("could not find default credentials: set " +
+	DefaultEnvPrefix + "_CLIENT_ID or " + CredentialsEnvVar +
+	", or create geoauth/" + credentialsFile + " in the user config directory")
+
+func readCredentialsFile(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return configFromProfile(b, "", os.Getenv(ProfileEnvVar))
+}
+
+// DefaultTokenSource returns the TokenSource of the config found by
+// FindDefaultConfig, refreshing tokens using ctx as with
+// Config.TokenSource.
+func DefaultTokenSource(ctx context.Context) (TokenSource, error) {
+	c, _, err := FindDefaultConfig()
+	if err != nil {
+		return nil, err
+	}
+	return c.TokenSource(ctx, nil), nil
+}
@@ -0,0 +1,161 @@
+package geoauth
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// setDefaultConfigEnv clears the sources of FindDefaultConfig and makes
+// the user config directory a temporary one, which it returns.
+func setDefaultConfigEnv(t *testing.T) string {
+	if runtime.GOOS != "linux" {
+		t.Skip("the user config directory is only set through XDG_CONFIG_HOME on Linux")
+	}
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("GEO_CLIENT_ID", "")
+	t.Setenv(CredentialsEnvVar, "")
+	t.Setenv(ProfileEnvVar, "")
+	return dir
+}
+
+func writeCredentials(t *testing.T, path, clientID string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	data := `{"client_id": "` + clientID + `", "client_secret": "CLIENT_SECRET"}`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindDefaultConfig(t *testing.T) {
+	dir := setDefaultConfigEnv(t)
+
+	if _, _, err := FindDefaultConfig(); err != errNoDefaultConfig {
+		t.Errorf("FindDefaultConfig without credentials error = %v; want %v", err, errNoDefaultConfig)
+	}
+
+	userPath := filepath.Join(dir, "geoauth", "geo_credentials.json")
+	writeCredentials(t, userPath, "USER_CLIENT_ID")
+	filePath := filepath.Join(dir, "credentials.json")
+	writeCredentials(t, filePath, "FILE_CLIENT_ID")
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		clientID string
+		source   ConfigSource
+	}{
+		{
+			name:     "user config dir",
+			clientID: "USER_CLIENT_ID",
+			source:   ConfigSource{Kind: SourceUserConfigDir, Path: userPath},
+		},
+		{
+			name:     "credentials file",
+			env:      map[string]string{CredentialsEnvVar: filePath},
+			clientID: "FILE_CLIENT_ID",
+			source:   ConfigSource{Kind: SourceCredentialsFile, Path: filePath},
+		},
+		{
+			name:     "env",
+			env:      map[string]string{CredentialsEnvVar: filePath, "GEO_CLIENT_ID": "ENV_CLIENT_ID"},
+			clientID: "ENV_CLIENT_ID",
+			source:   ConfigSource{Kind: SourceEnv},
+		},
+	}
+	for _, tt := range tests {
+		for k, v := range tt.env {
+			t.Setenv(k, v)
+		}
+		conf, source, err := FindDefaultConfig()
+		if err != nil {
+			t.Errorf("FindDefaultConfig (%q) error = %v", tt.name, err)
+			continue
+		}
+		if got, want := conf.ClientID, tt.clientID; got != want {
+			t.Errorf("FindDefaultConfig (%q) ClientID = %q; want %q", tt.name, got, want)
+		}
+		if got, want := source, tt.source; got != want {
+			t.Errorf("FindDefaultConfig (%q) source = %v; want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestFindDefaultConfigProfile(t *testing.T) {
+	dir := setDefaultConfigEnv(t)
+	path := filepath.Join(dir, "credentials.json")
+	if err := ioutil.WriteFile(path, []byte(profilesJSONKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(CredentialsEnvVar, path)
+
+	for profile, clientID := range map[string]string{
+		"":      "PRODUCTION_CLIENT_ID",
+		"local": "LOCAL_CLIENT_ID",
+	} {
+		t.Setenv(ProfileEnvVar, profile)
+		conf, _, err := FindDefaultConfig()
+		if err != nil {
+			t.Errorf("FindDefaultConfig (GEO_PROFILE=%q) error = %v", profile, err)
+			continue
+		}
+		if got, want := conf.ClientID, clientID; got != want {
+			t.Errorf("FindDefaultConfig (GEO_PROFILE=%q) ClientID = %q; want %q", profile, got, want)
+		}
+	}
+
+	t.Setenv(ProfileEnvVar, "missing")
+	if _, _, err := FindDefaultConfig(); err == nil {
+		t.Error("FindDefaultConfig with a missing GEO_PROFILE profile succeeded; want error")
+	}
+}
+
+func TestFindDefaultConfigErrors(t *testing.T) {
+	dir := setDefaultConfigEnv(t)
+
+	// A broken user config file is reported rather than skipped.
+	userPath := filepath.Join(dir, "geoauth", "geo_credentials.json")
+	writeCredentials(t, userPath, "USER_CLIENT_ID")
+	if err := ioutil.WriteFile(userPath, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := FindDefaultConfig(); err == nil {
+		t.Error("FindDefaultConfig with a broken user config file succeeded; want error")
+	}
+
+	// A missing GEO_APPLICATION_CREDENTIALS file is an error.
+	t.Setenv(CredentialsEnvVar, filepath.Join(dir, "missing.json"))
+	_, source, err := FindDefaultConfig()
+	if err == nil {
+		t.Error("FindDefaultConfig with a missing credentials file succeeded; want error")
+	}
+	if got, want := source.Kind, SourceCredentialsFile; got != want {
+		t.Errorf("source.Kind = %v; want %v", got, want)
+	}
+}
+
+func TestDefaultTokenSource(t *testing.T) {
+	setDefaultConfigEnv(t)
+	server := newEchoServer()
+	defer server.Close()
+	t.Setenv("GEO_CLIENT_ID", "CLIENT_ID")
+	t.Setenv("GEO_CLIENT_SECRET", "CLIENT_SECRET")
+	t.Setenv("GEO_AUTH_URL", server.LoginURL)
+
+	src, err := DefaultTokenSource(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := server.LoginCount(), 1; got != want {
+		t.Errorf("LoginCount = %d; want %d", got, want)
+	}
+}
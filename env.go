@@ -0,0 +1,54 @@
+package geoauth
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DefaultEnvPrefix is the prefix of the environment variables read by
+// ConfigFromEnv when given an empty prefix.
+const DefaultEnvPrefix = "GEO"
+
+// ConfigFromEnv constructs a config from the environment variables below,
+// named with the given prefix, or DefaultEnvPrefix if empty. Prefixes
+// such as "GEO_LOCAL" let several GEO accounts be configured for one
+// process.
+//
+//	GEO_CLIENT_ID             ClientID (required)
+//	GEO_CLIENT_SECRET         ClientSecret
+//	GEO_CLIENT_SECRET_KMS     "true" if GEO_CLIENT_SECRET is encrypted,
+//	                          setting EncryptedSecret
+//	GEO_AUTH_URL              AuthURL
+//	GEO_ENVIRONMENT           Environment, such as "local"
+func ConfigFromEnv(prefix string) (*Config, error) {
+	if prefix == "" {
+		prefix = DefaultEnvPrefix
+	}
+	prefix = strings.TrimSuffix(prefix, "_") + "_"
+
+	c := &Config{
+		ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+		ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		AuthURL:      os.Getenv(prefix + "AUTH_URL"),
+	}
+	if c.ClientID == "" {
+		return nil, fmt.Errorf("%sCLIENT_ID is not set", prefix)
+	}
+	if v := os.Getenv(prefix + "CLIENT_SECRET_KMS"); v != "" {
+		encrypted, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %sCLIENT_SECRET_KMS: %w", prefix, err)
+		}
+		c.EncryptedSecret = encrypted
+	}
+	if v := os.Getenv(prefix + "ENVIRONMENT"); v != "" {
+		env, err := ParseEnvironment(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %sENVIRONMENT: %w", prefix, err)
+		}
+		c.Environment = env
+	}
+	return c, nil
+}
@@ -0,0 +1,84 @@
+package geoauth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("GEO_CLIENT_ID", "CLIENT_ID")
+	t.Setenv("GEO_CLIENT_SECRET", "CLIENT_SECRET")
+	t.Setenv("GEO_AUTH_URL", "https://geo.example.com/login")
+	t.Setenv("GEO_LOCAL_CLIENT_ID", "LOCAL_CLIENT_ID")
+	t.Setenv("GEO_LOCAL_ENVIRONMENT", "local")
+
+	conf, err := ConfigFromEnv("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ClientID != "CLIENT_ID" || conf.ClientSecret != "CLIENT_SECRET" || conf.AuthURL != "https://geo.example.com/login" || conf.EncryptedSecret {
+		t.Errorf("ConfigFromEnv(%q) = %+v", "", conf)
+	}
+
+	for _, prefix := range []string{"GEO_LOCAL", "GEO_LOCAL_"} {
+		conf, err := ConfigFromEnv(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conf.ClientID != "LOCAL_CLIENT_ID" || conf.Environment != Local || conf.AuthURL != "" {
+			t.Errorf("ConfigFromEnv(%q) = %+v", prefix, conf)
+		}
+	}
+}
+
+func TestConfigFromEnvErrors(t *testing.T) {
+	if _, err := ConfigFromEnv("GEO_MISSING"); err == nil {
+		t.Error("ConfigFromEnv without CLIENT_ID succeeded; want error")
+	}
+
+	t.Setenv("GEO_CLIENT_ID", "CLIENT_ID")
+	t.Setenv("GEO_CLIENT_SECRET_KMS", "maybe")
+	if _, err := ConfigFromEnv(""); err == nil {
+		t.Error("ConfigFromEnv with an invalid KMS flag succeeded; want error")
+	}
+	t.Setenv("GEO_CLIENT_SECRET_KMS", "")
+	t.Setenv("GEO_ENVIRONMENT", "moon")
+	if _, err := ConfigFromEnv(""); err == nil {
+		t.Error("ConfigFromEnv with an unknown environment succeeded; want error")
+	}
+}
+
+func TestConfigFromEnvEncryptedSecret(t *testing.T) {
+	server := newEchoServer()
+	defer server.Close()
+	server.AddUser("CLIENT_ID", "PLAINTEXT")
+	t.Setenv("GEO_CLIENT_ID", "CLIENT_ID")
+	t.Setenv("GEO_CLIENT_SECRET", "CIPHERTEXT")
+	t.Setenv("GEO_CLIENT_SECRET_KMS", "true")
+	t.Setenv("GEO_AUTH_URL", server.LoginURL)
+
+	conf, err := ConfigFromEnv("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conf.EncryptedSecret {
+		t.Fatal("EncryptedSecret = false; want true")
+	}
+	conf.Decrypter = fakeDecrypter{"CIPHERTEXT": "PLAINTEXT"}
+
+	if _, err := conf.PasswordCredentialsToken(context.Background()); err != nil {
+		t.Errorf("PasswordCredentialsToken error = %v", err)
+	}
+	if _, err := conf.TokenSource(context.Background(), nil).Token(); err != nil {
+		t.Errorf("TokenSource error = %v", err)
+	}
+	res, err := conf.Client(context.Background(), nil).Get(server.URL + "/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got, want := res.StatusCode, http.StatusOK; got != want {
+		t.Errorf("StatusCode = %d; want %d", got, want)
+	}
+}
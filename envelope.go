@@ -0,0 +1,99 @@
+package geoauth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// A SecretCipher both encrypts and decrypts secrets, as KMSProvider
+// does.
+type SecretCipher interface {
+	SecretEncrypter
+	SecretDecrypter
+}
+
+// envelopeVersion is the version of the envelope format written by
+// sealEnvelope.
+const envelopeVersion = 1
+
+// envelope is data encrypted with AES-256-GCM under a random data key,
+// which is itself encrypted with a SecretEncrypter.
+type envelope struct {
+	Version    int    `json:"version"`
+	DataKey    string `json:"data_key"` // encrypted base64 of the data key
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// sealEnvelope encrypts plaintext under a new data key, authenticating
+// additionalData with it, and returns the encoded envelope.
+func sealEnvelope(ctx context.Context, e SecretEncrypter, plaintext, additionalData []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	dataKey, err := e.EncryptSecret(ctx, base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&envelope{
+		Version:    envelopeVersion,
+		DataKey:    dataKey,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, additionalData),
+	})
+}
+
+// errEnvelopeVersion is returned by openEnvelope for envelopes of an
+// unknown version.
+var errEnvelopeVersion = errors.New("unsupported envelope version")
+
+// openEnvelope decrypts an envelope encoded by sealEnvelope with the same
+// additionalData. It fails if the envelope has been tampered with.
+func openEnvelope(ctx context.Context, d SecretDecrypter, b, additionalData []byte) ([]byte, error) {
+	var env envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, err
+	}
+	if env.Version != envelopeVersion {
+		return nil, errEnvelopeVersion
+	}
+	encoded, err := d.DecryptSecret(ctx, env.DataKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	return aead.Open(nil, env.Nonce, env.Ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,60 @@
+package geoauth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// loginPath is the path of the login endpoint below the base URL of a
+// GEO environment.
+const loginPath = "/api/session/login"
+
+// An Environment names a GEO deployment, from which the URLs of its
+// endpoints are derived.
+type Environment string
+
+const (
+	// Production is the live GEO service, whose login endpoint is URL.
+	Production Environment = "production"
+
+	// Local is a GEO server running on the local machine. As it is
+	// served over plain http, Config.Validate only accepts it with
+	// Config.AllowInsecureLocalhost.
+	Local Environment = "local"
+)
+
+var environmentBaseURLs = map[Environment]string{
+	Production: "https://api.geocreation.com.au",
+	Local:      "http://localhost:3000",
+}
+
+// ParseEnvironment returns the Environment named s, ignoring case.
+func ParseEnvironment(s string) (Environment, error) {
+	e := Environment(strings.ToLower(s))
+	if _, ok := environmentBaseURLs[e]; !ok {
+		return "", unknownEnvironmentError(s)
+	}
+	return e, nil
+}
+
+func unknownEnvironmentError(s string) error {
+	return fmt.Errorf("unknown GEO environment %q", s)
+}
+
+// BaseURL returns the URL that the GEO API endpoints of e, such as the
+// session endpoints under /api/session, are relative to. It has no
+// trailing slash. Names are matched ignoring case. BaseURL returns an
+// empty string for an unknown environment.
+func (e Environment) BaseURL() string {
+	return environmentBaseURLs[Environment(strings.ToLower(string(e)))]
+}
+
+// AuthURL returns the URL of the login endpoint of e, or an empty string
+// for an unknown environment.
+func (e Environment) AuthURL() string {
+	base := e.BaseURL()
+	if base == "" {
+		return ""
+	}
+	return base + loginPath
+}
@@ -0,0 +1,42 @@
+package geoauth
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseEnvironment(t *testing.T) {
+	for _, s := range []string{"production", "Production", "LOCAL", "local"} {
+		if _, err := ParseEnvironment(s); err != nil {
+			t.Errorf("ParseEnvironment(%q) error = %v", s, err)
+		}
+	}
+	if env, err := ParseEnvironment("prod"); err == nil {
+		t.Errorf("ParseEnvironment(%q) = %q; want error", "prod", env)
+	}
+}
+
+func TestEnvironmentURLs(t *testing.T) {
+	if got, want := Production.AuthURL(), URL; got != want {
+		t.Errorf("Production.AuthURL() = %q; want %q", got, want)
+	}
+	if got, want := Local.BaseURL()+"/api/session", "http://localhost:3000/api/session"; got != want {
+		t.Errorf("Local session URL = %q; want %q", got, want)
+	}
+	if got := Environment("moon").AuthURL(); got != "" {
+		t.Errorf("AuthURL of an unknown environment = %q; want empty", got)
+	}
+}
+
+func TestUnknownEnvironmentLogin(t *testing.T) {
+	conf := &Config{ClientID: "CLIENT_ID", ClientSecret: "CLIENT_SECRET", Environment: "prod"}
+	_, err := conf.PasswordCredentialsToken(context.Background())
+	if err == nil || err.Error() != `unknown GEO environment "prod"` {
+		t.Errorf("PasswordCredentialsToken error = %v; want unknown GEO environment", err)
+	}
+
+	conf.Environment = "Local"
+	if got, want := conf.authURL(), Local.AuthURL(); got != want {
+		t.Errorf("authURL = %q; want %q", got, want)
+	}
+}
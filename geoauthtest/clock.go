@@ -0,0 +1,109 @@
+// Package geoauthtest provides utilities for testing code that uses
+// package geoauth.
+package geoauthtest
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a geoauth.Clock whose time only moves when told to.
+// It is safe for concurrent use.
+type FakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond // signaled when waiters changes
+	now     time.Time
+	waiters []*waiter
+}
+
+type waiter struct {
+	until time.Time
+	c     chan time.Time
+}
+
+// NewFakeClock returns a FakeClock whose time is now.
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTimer returns a channel that receives the time of the clock once
+// it has been advanced by at least d, and a function that stops the
+// timer, reporting whether it had yet to fire.
+func (c *FakeClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &waiter{until: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+		return w.c, func() bool { return false }
+	}
+	c.waiters = append(c.waiters, w)
+	c.cond.Broadcast()
+	return w.c, func() bool { return c.stop(w) }
+}
+
+// stop removes w from the waiting timers and reports whether it was
+// there.
+func (c *FakeClock) stop(w *waiter) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, w2 := range c.waiters {
+		if w2 == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			c.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward by d, firing the timers that are
+// due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.until.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = waiters
+	c.cond.Broadcast()
+}
+
+// Waiters returns the number of timers that have neither fired nor been
+// stopped.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// BlockUntil blocks until at least n timers are waiting to fire. It
+// lets tests advance the clock only once the code under test is waiting
+// on it.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+// systemClock tells the time with the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
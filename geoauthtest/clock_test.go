@@ -0,0 +1,67 @@
+package geoauthtest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2018, 2, 1, 8, 37, 49, 0, time.UTC)
+	c := NewFakeClock(start)
+	soon, _ := c.NewTimer(time.Second)
+	later, _ := c.NewTimer(time.Minute)
+	c.BlockUntil(2)
+
+	c.Advance(time.Second)
+	select {
+	case got := <-soon:
+		if want := start.Add(time.Second); !got.Equal(want) {
+			t.Errorf("NewTimer(1s) fired at %v; want %v", got, want)
+		}
+	default:
+		t.Errorf("NewTimer(1s) did not fire after advancing 1s")
+	}
+	select {
+	case <-later:
+		t.Errorf("NewTimer(1m) fired after advancing 1s")
+	default:
+	}
+	if got, want := c.Waiters(), 1; got != want {
+		t.Errorf("Waiters = %d; want %d", got, want)
+	}
+	if got, want := c.Now(), start.Add(time.Second); !got.Equal(want) {
+		t.Errorf("Now = %v; want %v", got, want)
+	}
+	now, _ := c.NewTimer(0)
+	select {
+	case <-now:
+	default:
+		t.Errorf("NewTimer(0) did not fire immediately")
+	}
+}
+
+func TestFakeClockStop(t *testing.T) {
+	c := NewFakeClock(time.Date(2018, 2, 1, 8, 37, 49, 0, time.UTC))
+	fired, stopFired := c.NewTimer(time.Second)
+	stopped, stop := c.NewTimer(time.Second)
+	if !stop() {
+		t.Error("stop of a pending timer = false; want true")
+	}
+	if stop() {
+		t.Error("second stop = true; want false")
+	}
+	if got, want := c.Waiters(), 1; got != want {
+		t.Errorf("Waiters after stop = %d; want %d", got, want)
+	}
+
+	c.Advance(time.Second)
+	select {
+	case <-stopped:
+		t.Error("stopped timer fired")
+	default:
+	}
+	<-fired
+	if stopFired() {
+		t.Error("stop of a fired timer = true; want false")
+	}
+}
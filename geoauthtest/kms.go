@@ -0,0 +1,287 @@
+package geoauthtest
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// KMSRegion is the AWS region reported by a KMSServer in its key ARNs.
+const KMSRegion = "us-east-1"
+
+// kmsAccount is the AWS account reported by a KMSServer in its key ARNs.
+const kmsAccount = "111122223333"
+
+// KMSServer is a local stand-in for AWS KMS. It implements the Encrypt
+// and Decrypt operations of the KMS JSON protocol with in-memory keys,
+// so that encrypted client secrets can be tested without AWS.
+//
+// Point a geoauth.KMSProvider at it by setting Endpoint to URL, Region
+// to KMSRegion and any static credentials, which are not checked:
+//
+//	p := &geoauth.KMSProvider{
+//		Region:          geoauthtest.KMSRegion,
+//		Endpoint:        s.URL,
+//		AccessKeyID:     "test",
+//		SecretAccessKey: "test",
+//		KeyID:           "alias/geo",
+//	}
+//
+// KMSServer is safe for concurrent use.
+type KMSServer struct {
+	// URL is the base URL of the server, of the form http://ipaddr:port
+	// with no trailing slash.
+	URL string
+
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]*kmsKey // by key ID
+	aliases map[string]string  // alias name to key ID
+}
+
+type kmsKey struct {
+	id     string
+	aead   cipher.AEAD
+	denied bool
+}
+
+func (k *kmsKey) arn() string {
+	return fmt.Sprintf("arn:aws:kms:%s:%s:key/%s", KMSRegion, kmsAccount, k.id)
+}
+
+// NewKMSServer starts and returns a new KMSServer without keys.
+// The caller should call Close when finished, to shut it down.
+func NewKMSServer() *KMSServer {
+	s := &KMSServer{
+		keys:    make(map[string]*kmsKey),
+		aliases: make(map[string]string),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+	return s
+}
+
+// Close shuts down the server and blocks until all outstanding requests
+// on this server have completed.
+func (s *KMSServer) Close() {
+	s.srv.Close()
+}
+
+// CreateKey creates a key and returns its ID. Aliases, such as
+// "alias/geo", can be used in place of the key ID.
+func (s *KMSServer) CreateKey(aliases ...string) string {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := &kmsKey{id: fmt.Sprintf("%08d-0000-0000-0000-000000000000", len(s.keys)+1), aead: aead}
+	s.keys[k.id] = k
+	for _, alias := range aliases {
+		s.aliases[alias] = k.id
+	}
+	return k.id
+}
+
+// DenyAccess makes requests using the key fail with
+// AccessDeniedException.
+func (s *KMSServer) DenyAccess(keyID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if k := s.key(keyID); k != nil {
+		k.denied = true
+	}
+}
+
+// EncryptSecret encrypts plaintext under keyID with the encryption
+// context and returns the base64-encoded ciphertext blob, as
+// geoauth.KMSProvider.EncryptSecret does.
+func (s *KMSServer) EncryptSecret(keyID, plaintext string, encryptionContext map[string]string) (string, error) {
+	s.mu.Lock()
+	k := s.key(keyID)
+	s.mu.Unlock()
+	if k == nil {
+		return "", fmt.Errorf("key %q does not exist", keyID)
+	}
+	blob, err := k.seal([]byte(plaintext), encryptionContext)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(blob), nil
+}
+
+// key returns the key with the given ID, ARN or alias, or nil.
+func (s *KMSServer) key(keyID string) *kmsKey {
+	if id, ok := s.aliases[keyID]; ok {
+		keyID = id
+	}
+	if i := strings.LastIndex(keyID, ":key/"); i >= 0 {
+		keyID = keyID[i+len(":key/"):]
+	}
+	return s.keys[keyID]
+}
+
+// A ciphertext blob is the key ID length, the key ID, the nonce and the
+// sealed plaintext, authenticated with the encryption context.
+
+func (k *kmsKey) seal(plaintext []byte, encryptionContext map[string]string) ([]byte, error) {
+	aad, err := additionalData(encryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	blob := append([]byte{byte(len(k.id))}, k.id...)
+	blob = append(blob, nonce...)
+	return k.aead.Seal(blob, nonce, plaintext, aad), nil
+}
+
+// keyIDOf returns the ID of the key that sealed blob.
+func keyIDOf(blob []byte) (string, bool) {
+	if len(blob) == 0 || len(blob) < 1+int(blob[0]) {
+		return "", false
+	}
+	return string(blob[1 : 1+blob[0]]), true
+}
+
+func (k *kmsKey) open(blob []byte, encryptionContext map[string]string) ([]byte, error) {
+	aad, err := additionalData(encryptionContext)
+	if err != nil {
+		return nil, err
+	}
+	blob = blob[1+len(k.id):]
+	if len(blob) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, sealed := blob[:k.aead.NonceSize()], blob[k.aead.NonceSize():]
+	return k.aead.Open(nil, nonce, sealed, aad)
+}
+
+// additionalData encodes an encryption context for AES-GCM. Map keys
+// are sorted by encoding/json, and an empty context is the same as none.
+func additionalData(encryptionContext map[string]string) ([]byte, error) {
+	if len(encryptionContext) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(encryptionContext)
+}
+
+// kmsRequest holds the parameters of the supported KMS operations.
+// Blobs are base64-encoded by encoding/json.
+type kmsRequest struct {
+	KeyId             string
+	Plaintext         []byte
+	CiphertextBlob    []byte
+	EncryptionContext map[string]string
+}
+
+func (s *KMSServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var req kmsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeKMSError(w, "SerializationException", err.Error())
+		return
+	}
+	switch op := r.Header.Get("X-Amz-Target"); op {
+	case "TrentService.Encrypt":
+		s.encrypt(w, &req)
+	case "TrentService.Decrypt":
+		s.decrypt(w, &req)
+	default:
+		writeKMSError(w, "UnknownOperationException", fmt.Sprintf("operation %q is not supported", op))
+	}
+}
+
+func (s *KMSServer) encrypt(w http.ResponseWriter, req *kmsRequest) {
+	s.mu.Lock()
+	k := s.key(req.KeyId)
+	denied := k != nil && k.denied
+	s.mu.Unlock()
+	if !checkKey(w, k, denied, req.KeyId) {
+		return
+	}
+	blob, err := k.seal(req.Plaintext, req.EncryptionContext)
+	if err != nil {
+		writeKMSError(w, "KMSInternalException", err.Error())
+		return
+	}
+	writeKMSResponse(w, map[string]interface{}{
+		"CiphertextBlob": blob,
+		"KeyId":          k.arn(),
+	})
+}
+
+func (s *KMSServer) decrypt(w http.ResponseWriter, req *kmsRequest) {
+	id, ok := keyIDOf(req.CiphertextBlob)
+	if !ok {
+		writeKMSError(w, "InvalidCiphertextException", "")
+		return
+	}
+	s.mu.Lock()
+	k := s.keys[id]
+	denied := k != nil && k.denied
+	s.mu.Unlock()
+	if k == nil {
+		writeKMSError(w, "InvalidCiphertextException", "")
+		return
+	}
+	if !checkKey(w, k, denied, id) {
+		return
+	}
+	plaintext, err := k.open(req.CiphertextBlob, req.EncryptionContext)
+	if err != nil {
+		writeKMSError(w, "InvalidCiphertextException", "")
+		return
+	}
+	writeKMSResponse(w, map[string]interface{}{
+		"KeyId":     k.arn(),
+		"Plaintext": plaintext,
+	})
+}
+
+// checkKey writes an error and reports false if k cannot be used.
+// denied is whether access to k was denied when it was looked up.
+func checkKey(w http.ResponseWriter, k *kmsKey, denied bool, keyID string) bool {
+	switch {
+	case k == nil:
+		writeKMSError(w, "NotFoundException", fmt.Sprintf("key %q does not exist", keyID))
+		return false
+	case denied:
+		writeKMSError(w, "AccessDeniedException", fmt.Sprintf("access to key %q is denied", keyID))
+		return false
+	}
+	return true
+}
+
+func writeKMSResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeKMSError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{
+		"__type":  code,
+		"message": message,
+	})
+}
@@ -0,0 +1,183 @@
+package geoauthtest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/benkim0414/geoauth"
+	"github.com/benkim0414/geoauth/geoauthtest"
+)
+
+func newKMSProvider(s *geoauthtest.KMSServer, keyID string) *geoauth.KMSProvider {
+	return &geoauth.KMSProvider{
+		Region:          geoauthtest.KMSRegion,
+		Endpoint:        s.URL,
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+		KeyID:           keyID,
+	}
+}
+
+func TestKMSServerEncryptDecrypt(t *testing.T) {
+	s := geoauthtest.NewKMSServer()
+	defer s.Close()
+	s.CreateKey("alias/geo")
+
+	p := newKMSProvider(s, "alias/geo")
+	p.EncryptionContext = map[string]string{"app": "geo"}
+	secret, err := p.EncryptSecret(context.Background(), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret == "password" {
+		t.Fatal("EncryptSecret returned the plaintext")
+	}
+	plaintext, err := p.DecryptSecret(context.Background(), secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := plaintext, "password"; got != want {
+		t.Errorf("DecryptSecret = %q; want %q", got, want)
+	}
+}
+
+func TestKMSServerDecryptErrors(t *testing.T) {
+	s := geoauthtest.NewKMSServer()
+	defer s.Close()
+	keyID := s.CreateKey()
+	deniedID := s.CreateKey()
+	encCtx := map[string]string{"app": "geo"}
+	secret, err := s.EncryptSecret(keyID, "password", encCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied, err := s.EncryptSecret(deniedID, "password", encCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.DenyAccess(deniedID)
+
+	tests := []struct {
+		name   string
+		secret string
+		encCtx map[string]string
+		want   geoauth.DecryptErrorKind
+	}{
+		{name: "wrong context", secret: secret, encCtx: map[string]string{"app": "other"}, want: geoauth.DecryptInvalidCiphertext},
+		{name: "no context", secret: secret, want: geoauth.DecryptInvalidCiphertext},
+		{name: "garbage", secret: "Z2FyYmFnZQ==", encCtx: encCtx, want: geoauth.DecryptInvalidCiphertext},
+		{name: "access denied", secret: denied, encCtx: encCtx, want: geoauth.DecryptAccessDenied},
+	}
+	for _, tt := range tests {
+		p := newKMSProvider(s, "")
+		p.EncryptionContext = tt.encCtx
+		_, err := p.DecryptSecret(context.Background(), tt.secret)
+		var dErr *geoauth.DecryptError
+		if !errors.As(err, &dErr) {
+			t.Errorf("DecryptSecret (%q) error = %v; want *DecryptError", tt.name, err)
+			continue
+		}
+		if got, want := dErr.Kind, tt.want; got != want {
+			t.Errorf("DecryptError.Kind (%q) = %v; want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestKMSServerDenyAccessConcurrent(t *testing.T) {
+	s := geoauthtest.NewKMSServer()
+	defer s.Close()
+	keyID := s.CreateKey()
+	p := newKMSProvider(s, keyID)
+	secret, err := p.EncryptSecret(context.Background(), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Run with -race: access may be denied while requests are served.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.DenyAccess(keyID)
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		p.DecryptSecret(context.Background(), secret)
+	}
+	close(stop)
+	wg.Wait()
+	if _, err := p.DecryptSecret(context.Background(), secret); err == nil {
+		t.Error("DecryptSecret after DenyAccess succeeded; want error")
+	}
+}
+
+func TestKMSServerIgnoresSharedConfig(t *testing.T) {
+	// A missing CA bundle and an unknown profile break the shared AWS
+	// configuration, which static credentials do not need.
+	t.Setenv("AWS_CA_BUNDLE", "testdata/missing-ca-bundle.pem")
+	t.Setenv("AWS_PROFILE", "missing")
+	s := geoauthtest.NewKMSServer()
+	defer s.Close()
+	s.CreateKey("alias/geo")
+
+	p := newKMSProvider(s, "alias/geo")
+	ciphertext, err := p.EncryptSecret(context.Background(), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := p.DecryptSecret(context.Background(), ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := plaintext, "password"; got != want {
+		t.Errorf("DecryptSecret = %q; want %q", got, want)
+	}
+}
+
+func TestKMSCredentialsTokenEndToEnd(t *testing.T) {
+	kms := geoauthtest.NewKMSServer()
+	defer kms.Close()
+	kms.CreateKey("alias/geo")
+	s := geoauthtest.NewServer()
+	defer s.Close()
+	s.AddUser("user@example.com", "password")
+
+	// Encrypt the secret into a credentials file and read it back.
+	p := newKMSProvider(kms, "alias/geo")
+	var buf bytes.Buffer
+	if err := newConfig(s, "password").WriteEncryptedJSON(context.Background(), &buf, p); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := geoauth.ConfigFromJSON(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.AuthURL = s.LoginURL
+	conf.Decrypter = p
+
+	tok, err := conf.KMSCredentialsToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tok.Valid() {
+		t.Errorf("token = %#v; want a valid token", tok)
+	}
+
+	tok, err = conf.KMSTokenSource(context.Background(), nil).Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tok.Valid() {
+		t.Errorf("KMSTokenSource token = %#v; want a valid token", tok)
+	}
+}
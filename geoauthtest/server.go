@@ -0,0 +1,367 @@
+package geoauthtest
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LoginPath is the path of the login endpoint of a Server.
+const LoginPath = "/api/session/login"
+
+// DefaultTokenLifetime is the lifetime of the tokens issued by a Server
+// unless changed with SetTokenLifetime.
+const DefaultTokenLifetime = time.Hour
+
+// expiryLayout is the format of the expiresAt field sent by GEO, a UTC
+// time without an offset.
+const expiryLayout = "2006-01-02T15:04:05.9999999"
+
+// Server is a fake GEO authentication server. Its login endpoint at
+// LoginURL issues tokens to registered users, and every other path is a
+// protected resource that requires a valid token.
+//
+// Failures can be scripted with FailNext. Server is safe for concurrent
+// use.
+type Server struct {
+	// URL is the base URL of the server, of the form http://ipaddr:port
+	// with no trailing slash.
+	URL string
+
+	// LoginURL is the URL of the login endpoint, for use as
+	// geoauth.Config.AuthURL.
+	LoginURL string
+
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	clock    interface{ Now() time.Time }
+	lifetime time.Duration
+	users    map[string]*user // by email
+	sessions map[string]*session
+	failures []Failure
+	handler  http.Handler
+	logins   int
+	requests int
+}
+
+type user struct {
+	id       string
+	password string
+}
+
+type session struct {
+	id      string
+	user    *user
+	expiry  time.Time
+	revoked bool
+}
+
+// NewServer starts and returns a new Server.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		clock:    systemClock{},
+		lifetime: DefaultTokenLifetime,
+		users:    make(map[string]*user),
+		sessions: make(map[string]*session),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.srv.URL
+	s.LoginURL = s.srv.URL + LoginPath
+	return s
+}
+
+// Close shuts down the server and blocks until all outstanding requests
+// on this server have completed.
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// AddUser registers a user that can log in with email and password.
+// If no users are registered, any email and password are accepted.
+func (s *Server) AddUser(email, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[email] = &user{
+		id:       fmt.Sprintf("user-%d", len(s.users)+1),
+		password: password,
+	}
+}
+
+// SetTokenLifetime sets the lifetime of the tokens issued from now on.
+func (s *Server) SetTokenLifetime(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lifetime = d
+}
+
+// SetClock makes the server issue and expire tokens according to c,
+// such as a FakeClock shared with the code under test. The Date header
+// of login responses also follows c.
+func (s *Server) SetClock(c interface{ Now() time.Time }) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = c
+}
+
+// Handle sets the handler serving protected resources to authorized
+// requests. By default, they are answered with an empty JSON object.
+func (s *Server) Handle(h http.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = h
+}
+
+// FailNext makes the next logins fail as described by failures, one
+// failure per login, in order.
+func (s *Server) FailNext(failures ...Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failures...)
+}
+
+// Revoke ends the session of token before its expiry, so that requests
+// using it are rejected with 401 Unauthorized.
+func (s *Server) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.sessions[token]; ok {
+		sess.revoked = true
+	}
+}
+
+// RevokeAll ends all the sessions issued so far.
+func (s *Server) RevokeAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		sess.revoked = true
+	}
+}
+
+// LoginCount returns the number of requests made to the login endpoint,
+// including failed ones.
+func (s *Server) LoginCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+// RequestCount returns the number of requests made for protected
+// resources, including unauthorized ones.
+func (s *Server) RequestCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == LoginPath {
+		s.serveLogin(w, r)
+		return
+	}
+	s.serveResource(w, r)
+}
+
+func (s *Server) serveLogin(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.logins++
+	var f *Failure
+	if len(s.failures) > 0 {
+		f = &s.failures[0]
+		s.failures = s.failures[1:]
+	}
+	now := s.clock.Now()
+	s.mu.Unlock()
+
+	// Clients correct token expiry for the skew between their clock and
+	// the Date header, which must therefore follow the server's clock.
+	w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+
+	if f != nil {
+		if f.Delay > 0 {
+			select {
+			case <-time.After(f.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if f.StatusCode != 0 || f.Body != "" {
+			f.write(w)
+			return
+		}
+	}
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var req struct {
+		User struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		} `json:"user"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	token, sess, ok := s.login(req.User.Email, req.User.Password)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Invalid email or password")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"authenticationToken": map[string]string{
+			"_id":       sess.id,
+			"_type":     "AuthenticationToken",
+			"token":     token,
+			"expiresAt": sess.expiry.UTC().Format(expiryLayout),
+			"userId":    sess.user.id,
+		},
+	})
+}
+
+// login checks the credentials and starts a new session.
+func (s *Server) login(email, password string) (string, *session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[email]
+	if len(s.users) == 0 {
+		u, ok = &user{id: "user-" + email, password: password}, true
+	}
+	if !ok || u.password != password {
+		return "", nil, false
+	}
+	token := randomString(32)
+	sess := &session{
+		id:     randomString(24),
+		user:   u,
+		expiry: s.clock.Now().Add(s.lifetime),
+	}
+	s.sessions[token] = sess
+	return token, sess, true
+}
+
+func (s *Server) serveResource(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests++
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "token ")
+	sess, ok := s.sessions[token]
+	valid := ok && !sess.revoked && s.clock.Now().Before(sess.expiry)
+	h := s.handler
+	s.mu.Unlock()
+
+	if !valid {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+	if h == nil {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, "{}")
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// A Failure describes how a login attempt fails.
+type Failure struct {
+	// StatusCode is the status code of the response. If zero and Body
+	// is empty, the login proceeds normally after Delay.
+	StatusCode int
+
+	// StatusMessage is the message of the GEO error body sent with
+	// StatusCode, if Body is empty.
+	StatusMessage string
+
+	// RetryAfter, if positive, is sent in a Retry-After header.
+	RetryAfter time.Duration
+
+	// Delay is how long to wait before responding.
+	Delay time.Duration
+
+	// Body, if not empty, is sent as is instead of a GEO error body.
+	Body string
+}
+
+// BadRequest is the failure of a login with a wrong email or password.
+func BadRequest() Failure {
+	return Failure{StatusCode: http.StatusBadRequest, StatusMessage: "Invalid email or password"}
+}
+
+// Unauthorized is a login rejected with 401 Unauthorized.
+func Unauthorized() Failure {
+	return Failure{StatusCode: http.StatusUnauthorized, StatusMessage: "Unauthorized"}
+}
+
+// RateLimited is a login rejected with 429 Too Many Requests, asking to
+// retry after the given duration.
+func RateLimited(retryAfter time.Duration) Failure {
+	return Failure{StatusCode: http.StatusTooManyRequests, StatusMessage: "Too many requests", RetryAfter: retryAfter}
+}
+
+// ServerError is a login failing with the given 5xx status code.
+func ServerError(code int) Failure {
+	return Failure{StatusCode: code, StatusMessage: http.StatusText(code)}
+}
+
+// Slow is a login that succeeds after the given delay.
+func Slow(delay time.Duration) Failure {
+	return Failure{Delay: delay}
+}
+
+// MalformedJSON is a login answered with 200 OK and a truncated body.
+func MalformedJSON() Failure {
+	return Failure{StatusCode: http.StatusOK, Body: `{"authenticationToken": {"token": `}
+}
+
+func (f *Failure) write(w http.ResponseWriter) {
+	if f.RetryAfter > 0 {
+		secs := (f.RetryAfter + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.Itoa(int(secs)))
+	}
+	code := f.StatusCode
+	if code == 0 {
+		code = http.StatusOK
+	}
+	if f.Body != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		io.WriteString(w, f.Body)
+		return
+	}
+	writeError(w, code, f.StatusMessage)
+}
+
+// writeError writes a GEO error body.
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"statusMessage": message})
+}
+
+const alphanumeric = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// randomString returns a random alphanumeric string of length n.
+func randomString(n int) string {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(alphanumeric)))
+	for i := range b {
+		j, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = alphanumeric[j.Int64()]
+	}
+	return string(b)
+}
@@ -0,0 +1,178 @@
+package geoauthtest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benkim0414/geoauth"
+	"github.com/benkim0414/geoauth/geoauthtest"
+)
+
+func newConfig(s *geoauthtest.Server, password string) *geoauth.Config {
+	return &geoauth.Config{
+		ClientID:     "user@example.com",
+		ClientSecret: password,
+		AuthURL:      s.LoginURL,
+	}
+}
+
+func TestServerLogin(t *testing.T) {
+	s := geoauthtest.NewServer()
+	defer s.Close()
+	s.AddUser("user@example.com", "password")
+
+	tok, err := newConfig(s, "password").PasswordCredentialsToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tok.Valid() || tok.UserID == "" || tok.SessionID == "" {
+		t.Errorf("token = %#v; want a valid token with a session and user ID", tok)
+	}
+
+	_, err = newConfig(s, "wrong").PasswordCredentialsToken(context.Background())
+	if !errors.Is(err, geoauth.ErrInvalidCredentials) {
+		t.Errorf("error with wrong password = %v; want %v", err, geoauth.ErrInvalidCredentials)
+	}
+	if got, want := s.LoginCount(), 2; got != want {
+		t.Errorf("LoginCount = %d; want %d", got, want)
+	}
+}
+
+func TestServerTokenLifetime(t *testing.T) {
+	clock := geoauthtest.NewFakeClock(time.Date(2018, 2, 1, 8, 0, 0, 0, time.UTC))
+	s := geoauthtest.NewServer()
+	defer s.Close()
+	s.SetClock(clock)
+	s.SetTokenLifetime(time.Minute)
+
+	conf := newConfig(s, "password")
+	conf.Clock = clock
+	client := conf.Client(context.Background(), nil)
+	get := func() {
+		t.Helper()
+		res, err := client.Get(s.URL + "/api/resource")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("StatusCode = %d; want %d", res.StatusCode, http.StatusOK)
+		}
+	}
+
+	get()
+	get()
+	if got, want := s.LoginCount(), 1; got != want {
+		t.Errorf("LoginCount before expiry = %d; want %d", got, want)
+	}
+	clock.Advance(time.Minute)
+	get()
+	if got, want := s.LoginCount(), 2; got != want {
+		t.Errorf("LoginCount after expiry = %d; want %d", got, want)
+	}
+}
+
+func TestServerRevoke(t *testing.T) {
+	s := geoauthtest.NewServer()
+	defer s.Close()
+	client := newConfig(s, "password").Client(context.Background(), nil)
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(s.URL + "/api/resource")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("StatusCode = %d; want %d", res.StatusCode, http.StatusOK)
+		}
+		s.RevokeAll()
+	}
+	if got, want := s.LoginCount(), 2; got != want {
+		t.Errorf("LoginCount = %d; want %d", got, want)
+	}
+	if got, want := s.RequestCount(), 3; got != want {
+		t.Errorf("RequestCount = %d; want %d", got, want)
+	}
+}
+
+func TestServerHandle(t *testing.T) {
+	s := geoauthtest.NewServer()
+	defer s.Close()
+	s.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	client := newConfig(s, "password").Client(context.Background(), &geoauth.Token{AccessToken: "REVOKED"})
+
+	res, err := client.Post(s.URL+"/api/resource", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if got, want := res.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("StatusCode = %d; want %d", got, want)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if got, want := string(body), "payload"; got != want {
+		t.Errorf("body = %q; want %q", got, want)
+	}
+	if got, want := s.LoginCount(), 1; got != want {
+		t.Errorf("LoginCount = %d; want %d", got, want)
+	}
+}
+
+func TestServerFailures(t *testing.T) {
+	tests := []struct {
+		name    string
+		failure geoauthtest.Failure
+		want    error
+	}{
+		{name: "bad request", failure: geoauthtest.BadRequest(), want: geoauth.ErrInvalidCredentials},
+		{name: "unauthorized", failure: geoauthtest.Unauthorized(), want: geoauth.ErrInvalidCredentials},
+		{name: "rate limited", failure: geoauthtest.RateLimited(time.Minute), want: geoauth.ErrRateLimited},
+		{name: "server error", failure: geoauthtest.ServerError(http.StatusBadGateway), want: geoauth.ErrServerUnavailable},
+	}
+	for _, tt := range tests {
+		s := geoauthtest.NewServer()
+		s.FailNext(tt.failure)
+		_, err := newConfig(s, "password").PasswordCredentialsToken(context.Background())
+		s.Close()
+		if !errors.Is(err, tt.want) {
+			t.Errorf("error (%q) = %v; want %v", tt.name, err, tt.want)
+		}
+	}
+
+	s := geoauthtest.NewServer()
+	defer s.Close()
+	s.FailNext(geoauthtest.MalformedJSON())
+	if _, err := newConfig(s, "password").PasswordCredentialsToken(context.Background()); err == nil {
+		t.Errorf("error (malformed JSON) = nil; want error")
+	}
+
+	s.FailNext(geoauthtest.Slow(time.Second))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := newConfig(s, "password").PasswordCredentialsToken(ctx); err == nil {
+		t.Errorf("error (slow) = nil; want error")
+	}
+}
+
+func TestServerRetry(t *testing.T) {
+	s := geoauthtest.NewServer()
+	defer s.Close()
+	s.FailNext(geoauthtest.ServerError(http.StatusServiceUnavailable), geoauthtest.ServerError(http.StatusBadGateway))
+
+	conf := newConfig(s, "password")
+	conf.Retry = &geoauth.RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond}
+	if _, err := conf.PasswordCredentialsToken(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.LoginCount(), 3; got != want {
+		t.Errorf("LoginCount = %d; want %d", got, want)
+	}
+}
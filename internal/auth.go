@@ -1,39 +1,171 @@
 package internal
 
 import (
+	"context"
 	"encoding/base64"
+	"fmt"
 
-	"github.com/aws/aws-sdk-go-v2/aws/endpoints"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/aws/defaults"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/kms"
 )
 
 const awsRegion = "us-east-1"
 
-// DecryptSecret converts the encrypted client secret to password string.
-func DecryptSecret(secret string) (string, error) {
-	// Using the SDK's default configuration, loading additional config
-	// and credentials values from the environment variables, shared
-	// credentials, and shared configuration files
-	cfg, err := external.LoadDefaultAWSConfig()
-	if err != nil {
-		panic("failed to load config, " + err.Error())
+// KMSConfig holds the settings used to construct an AWS KMS client.
+type KMSConfig struct {
+	// Region is the AWS region of the KMS keys. If empty, us-east-1
+	// is used.
+	Region string
+	// Profile is the shared config profile to load credentials from.
+	// If empty, the SDK's default profile selection applies.
+	Profile string
+	// Endpoint overrides the KMS endpoint URL.
+	Endpoint string
+	// AccessKeyID and SecretAccessKey, if set, are static credentials
+	// used instead of the AWS configuration, which is then not loaded.
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// NewKMSClient returns a KMS client configured by c. A failure to load
+// the AWS configuration is reported as a *DecryptError.
+//
+// If c has static credentials, the shared configuration files are not
+// read, so that a KMS stand-in can be used on machines whose AWS
+// configuration is missing or broken.
+func NewKMSClient(c KMSConfig) (*kms.KMS, error) {
+	var cfg aws.Config
+	if c.AccessKeyID != "" {
+		cfg = defaults.Config()
+		cfg.Credentials = aws.NewStaticCredentialsProvider(c.AccessKeyID, c.SecretAccessKey, "")
+	} else {
+		// Using the SDK's default configuration, loading additional config
+		// and credentials values from the environment variables, shared
+		// credentials, and shared configuration files
+		var configs []external.Config
+		if c.Profile != "" {
+			configs = append(configs, external.WithSharedConfigProfile(c.Profile))
+		}
+		var err error
+		if cfg, err = external.LoadDefaultAWSConfig(configs...); err != nil {
+			return nil, &DecryptError{Kind: DecryptConfigLoad, Err: err}
+		}
 	}
 
 	// Set the AWS Region that the service clients should use
-	cfg.Region = endpoints.UsEast1RegionID
+	cfg.Region = c.Region
+	if cfg.Region == "" {
+		cfg.Region = awsRegion
+	}
+	if c.Endpoint != "" {
+		cfg.EndpointResolver = aws.ResolveWithEndpointURL(c.Endpoint)
+	}
+	return kms.New(cfg), nil
+}
 
-	svc := kms.New(cfg)
+// DecryptSecret converts the encrypted client secret to password string.
+// Errors are reported as a *DecryptError.
+func DecryptSecret(ctx context.Context, svc *kms.KMS, secret string, encryptionContext map[string]string) (string, error) {
 	blob, err := base64.StdEncoding.DecodeString(secret)
 	if err != nil {
-		return "", err
+		return "", &DecryptError{Kind: DecryptBase64, Err: err}
 	}
 	req := svc.DecryptRequest(&kms.DecryptInput{
-		CiphertextBlob: blob,
+		CiphertextBlob:    blob,
+		EncryptionContext: encryptionContext,
 	})
+	req.SetContext(ctx)
 	result, err := req.Send()
 	if err != nil {
-		return "", err
+		return "", &DecryptError{Kind: decryptErrorKind(err), Err: err}
 	}
 	return string(result.Plaintext), nil
 }
+
+// EncryptSecret encrypts the plaintext client secret under the KMS key
+// keyID and returns the base64-encoded ciphertext blob.
+func EncryptSecret(ctx context.Context, svc *kms.KMS, keyID, plaintext string, encryptionContext map[string]string) (string, error) {
+	req := svc.EncryptRequest(&kms.EncryptInput{
+		KeyId:             aws.String(keyID),
+		Plaintext:         []byte(plaintext),
+		EncryptionContext: encryptionContext,
+	})
+	req.SetContext(ctx)
+	result, err := req.Send()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(result.CiphertextBlob), nil
+}
+
+// DecryptErrorKind classifies the failures of DecryptSecret.
+// geoauth.DecryptErrorKind is an alias of it.
+type DecryptErrorKind int
+
+const (
+	// DecryptUnknown is any failure not covered by the other kinds,
+	// such as a network error or a disabled key.
+	DecryptUnknown DecryptErrorKind = iota
+
+	// DecryptConfigLoad means the AWS configuration or credentials
+	// could not be loaded.
+	DecryptConfigLoad
+
+	// DecryptBase64 means the secret is not valid base64.
+	DecryptBase64
+
+	// DecryptAccessDenied means the credentials are not allowed to
+	// use the key.
+	DecryptAccessDenied
+
+	// DecryptInvalidCiphertext means the secret is not a ciphertext
+	// of the key, or the encryption context does not match.
+	DecryptInvalidCiphertext
+)
+
+func (k DecryptErrorKind) String() string {
+	switch k {
+	case DecryptConfigLoad:
+		return "cannot load AWS config"
+	case DecryptBase64:
+		return "invalid base64"
+	case DecryptAccessDenied:
+		return "access denied"
+	case DecryptInvalidCiphertext:
+		return "invalid ciphertext"
+	}
+	return "unknown error"
+}
+
+// decryptErrorKind classifies an error returned by the KMS service.
+func decryptErrorKind(err error) DecryptErrorKind {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return DecryptUnknown
+	}
+	switch aerr.Code() {
+	case "NoCredentialProviders":
+		return DecryptConfigLoad
+	case "AccessDeniedException":
+		return DecryptAccessDenied
+	case kms.ErrCodeInvalidCiphertextException, kms.ErrCodeIncorrectKeyMaterialException:
+		return DecryptInvalidCiphertext
+	}
+	return DecryptUnknown
+}
+
+// DecryptError is the error returned by NewKMSClient and DecryptSecret.
+// geoauth maps it into a *geoauth.DecryptError.
+type DecryptError struct {
+	// Kind classifies the failure.
+	Kind DecryptErrorKind
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *DecryptError) Error() string {
+	return fmt.Sprintf("cannot decrypt secret: %v", e.Err)
+}
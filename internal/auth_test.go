@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecryptSecretWithEndpoint(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.Header.Get("X-Amz-Target"), "TrentService.Decrypt"; got != want {
+			t.Errorf("X-Amz-Target header = %q; want %q", got, want)
+		}
+		if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "/ap-southeast-2/kms/") {
+			t.Errorf("Authorization header = %q; want ap-southeast-2 credential scope", auth)
+		}
+		var in struct {
+			CiphertextBlob    []byte
+			EncryptionContext map[string]string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			t.Error(err)
+			return
+		}
+		if got, want := string(in.CiphertextBlob), "CIPHERTEXT"; got != want {
+			t.Errorf("CiphertextBlob = %q; want %q", got, want)
+		}
+		if got, want := in.EncryptionContext["app"], "geo"; got != want {
+			t.Errorf("EncryptionContext[app] = %q; want %q", got, want)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": []byte("PLAINTEXT")})
+	}))
+	defer ts.Close()
+
+	svc, err := NewKMSClient(KMSConfig{Region: "ap-southeast-2", Endpoint: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := base64.StdEncoding.EncodeToString([]byte("CIPHERTEXT"))
+	plaintext, err := DecryptSecret(context.Background(), svc, secret, map[string]string{"app": "geo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := plaintext, "PLAINTEXT"; got != want {
+		t.Errorf("DecryptSecret = %q; want %q", got, want)
+	}
+}
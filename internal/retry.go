@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+// RetryPolicy configures how RetrieveToken retries transient failures.
+// It is mirrored by geoauth.RetryPolicy.
+type RetryPolicy struct {
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+}
+
+// backoff reports whether another attempt should follow the given failed
+// attempt, and how long to wait before it. A nil policy never retries.
+func (p *RetryPolicy) backoff(ctx context.Context, clock Clock, attempt int, err error) (time.Duration, bool) {
+	if p == nil || attempt >= p.MaxAttempts || ctx.Err() != nil {
+		return 0, false
+	}
+	min, max := p.MinBackoff, p.MaxBackoff
+	if min <= 0 {
+		min = defaultMinBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+
+	if rErr, ok := err.(*RetrieveError); ok {
+		if !retryableStatus(rErr.Response.StatusCode) {
+			return 0, false
+		}
+		if wait, ok := retryAfter(rErr.Response, clock.Now()); ok {
+			// Give up rather than retry earlier than the server asked.
+			return wait, wait <= max
+		}
+	} else if !transientError(err) {
+		return 0, false
+	}
+
+	wait := min << uint(attempt-1)
+	if wait > max || wait <= 0 {
+		wait = max
+	}
+	// Wait between half and all of the backoff, so that clients failing
+	// together do not retry together.
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(wait-half)+1)), true
+}
+
+// retryableStatus reports whether a login response with the status code
+// is a transient failure. Rejected credentials are never retried.
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// transientError reports whether err is a network failure that may not
+// happen again: a timeout, a temporary DNS failure, or a connection reset
+// or closed by the server. Permanent failures, such as an unknown host or
+// a refused connection, are not retried.
+func transientError(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var dErr *net.DNSError
+	if errors.As(err, &dErr) {
+		return dErr.IsTimeout || dErr.IsTemporary
+	}
+	var nErr net.Error
+	return errors.As(err, &nErr) && nErr.Timeout()
+}
+
+// retryAfter returns the wait from now requested by the Retry-After
+// header of a 429 or 503 response.
+func retryAfter(r *http.Response, now time.Time) (time.Duration, bool) {
+	if r.StatusCode != http.StatusTooManyRequests && r.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	v := r.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		wait := t.Sub(now)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// sleep waits for d to elapse on clock or until ctx is done.
+func sleep(ctx context.Context, clock Clock, d time.Duration) error {
+	c, stop := clock.NewTimer(d)
+	defer stop()
+	select {
+	case <-c:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
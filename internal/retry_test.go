@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var testRetryPolicy = &RetryPolicy{
+	MaxAttempts: 3,
+	MinBackoff:  time.Millisecond,
+	MaxBackoff:  10 * time.Millisecond,
+}
+
+// newScriptedServer returns a server that replies to the n-th request
+// with responses[n], or with a token once responses run out.
+func newScriptedServer(responses ...func(w http.ResponseWriter)) (*httptest.Server, *int) {
+	calls := new(int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if *calls <= len(responses) {
+			responses[*calls-1](w)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"authenticationToken": {"token": "ACCESS_TOKEN", "expiresAt": "2018-02-01T08:37:49.3844879"}}`)
+	}))
+	return ts, calls
+}
+
+func status(code int, header ...string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for i := 0; i+1 < len(header); i += 2 {
+			w.Header().Set(header[i], header[i+1])
+		}
+		w.WriteHeader(code)
+	}
+}
+
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+}
+
+func TestRetrieveTokenRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []func(w http.ResponseWriter)
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			name:      "transient statuses",
+			responses: []func(w http.ResponseWriter){status(http.StatusBadGateway), status(http.StatusGatewayTimeout)},
+			wantCalls: 3,
+		},
+		{
+			name:      "connection reset",
+			responses: []func(w http.ResponseWriter){resetConnection},
+			wantCalls: 2,
+		},
+		{
+			name:      "retry after",
+			responses: []func(w http.ResponseWriter){status(http.StatusTooManyRequests, "Retry-After", "0")},
+			wantCalls: 2,
+		},
+		{
+			name:      "retry after too long",
+			responses: []func(w http.ResponseWriter){status(http.StatusServiceUnavailable, "Retry-After", "60")},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "invalid credentials",
+			responses: []func(w http.ResponseWriter){status(http.StatusBadRequest), status(http.StatusBadRequest)},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name: "exhausted",
+			responses: []func(w http.ResponseWriter){
+				status(http.StatusServiceUnavailable), status(http.StatusServiceUnavailable), status(http.StatusServiceUnavailable),
+			},
+			wantCalls: 3,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		ts, calls := newScriptedServer(tt.responses...)
+		_, err := RetrieveToken(context.Background(), "CLIENT_ID", "", ts.URL, &RetrieveOptions{Retry: testRetryPolicy})
+		ts.Close()
+		if got, want := err != nil, tt.wantErr; got != want {
+			t.Errorf("RetrieveToken (%q) error = %v; want error %v", tt.name, err, want)
+		}
+		if got, want := *calls, tt.wantCalls; got != want {
+			t.Errorf("RetrieveToken (%q) calls = %d; want %d", tt.name, got, want)
+		}
+		if rErr, ok := err.(*RetrieveError); ok && rErr.Attempts != tt.wantCalls {
+			t.Errorf("RetrieveError.Attempts (%q) = %d; want %d", tt.name, rErr.Attempts, tt.wantCalls)
+		}
+	}
+}
+
+func TestRetrieveTokenRetryError(t *testing.T) {
+	ts, _ := newScriptedServer(resetConnection, resetConnection, resetConnection)
+	defer ts.Close()
+	_, err := RetrieveToken(context.Background(), "CLIENT_ID", "", ts.URL, &RetrieveOptions{Retry: testRetryPolicy})
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("RetrieveToken error = %v; want error mentioning 3 attempts", err)
+	}
+}
+
+// timeoutError is a net.Error reporting a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestTransientError(t *testing.T) {
+	dial := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://example.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: err}}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"EOF", &url.Error{Op: "Post", URL: "https://example.com", Err: io.EOF}, true},
+		{"timeout", dial(timeoutError{}), true},
+		{"connection reset", dial(os.NewSyscallError("read", syscall.ECONNRESET)), true},
+		{"connection refused", dial(os.NewSyscallError("connect", syscall.ECONNREFUSED)), false},
+		{"temporary DNS failure", dial(&net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}), true},
+		{"unknown host", dial(&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}), false},
+	}
+	for _, tt := range tests {
+		if got := transientError(tt.err); got != tt.want {
+			t.Errorf("transientError (%q) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
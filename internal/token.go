@@ -1,13 +1,13 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"strings"
 	"time"
 
 	"golang.org/x/net/context/ctxhttp"
@@ -28,6 +28,14 @@ type Token struct {
 
 	// Expiry is the optional expiration time of the access token.
 	Expiry time.Time
+
+	// ID, Type and UserID identify the GEO session and its user.
+	ID     string
+	Type   string
+	UserID string
+
+	// Raw holds all the fields of the authenticationToken object.
+	Raw map[string]interface{}
 }
 
 // tokenJSON is the struct representing the HTTP response from GEO
@@ -40,14 +48,142 @@ type tokenJSON struct {
 	UserID    string `json:"userId"`
 }
 
-func (t *tokenJSON) expiry() (time.Time, error) {
+// expiry parses ExpiresAt, which is either an RFC 3339 time or a time
+// without a UTC offset, which is taken to be in loc (UTC if nil).
+func (t *tokenJSON) expiry(loc *time.Location) (time.Time, error) {
+	if e, err := time.Parse(time.RFC3339Nano, t.ExpiresAt); err == nil {
+		return e, nil
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
 	const layout = "2006-01-02T15:04:05.999999999"
-	return time.Parse(layout, t.ExpiresAt)
+	return time.ParseInLocation(layout, t.ExpiresAt, loc)
 }
 
-func RetrieveToken(ctx context.Context, email, password, authURL string) (*Token, error) {
-	payload := fmt.Sprintf(`{"user": {"email": %q, "password": %q}}`, email, password)
-	req, err := http.NewRequest(http.MethodPost, authURL, strings.NewReader(payload))
+// maxIgnoredSkew is the largest clock skew between the client and the
+// authentication server that is not corrected. The Date header has a
+// resolution of one second, and the response takes time to arrive, so
+// smaller differences cannot be told apart from noise.
+const maxIgnoredSkew = 2 * time.Second
+
+// clockSkew returns how far the clock of the server that sent r, as told
+// by its Date header, is ahead of the local clock at now.
+func clockSkew(r *http.Response, now time.Time) time.Duration {
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return 0
+	}
+	skew := date.Sub(now)
+	if -maxIgnoredSkew <= skew && skew <= maxIgnoredSkew {
+		return 0
+	}
+	return skew
+}
+
+// loginRequest is the body of a login request.
+type loginRequest struct {
+	User loginUser `json:"user"`
+}
+
+// loginUser is the user object of a login request. Extra fields are
+// encoded alongside email and password, which they cannot override.
+type loginUser struct {
+	Email    string
+	Password string
+	Extra    map[string]interface{}
+}
+
+func (u loginUser) MarshalJSON() ([]byte, error) {
+	fields := make(map[string]interface{}, len(u.Extra)+2)
+	for k, v := range u.Extra {
+		fields[k] = v
+	}
+	fields["email"] = u.Email
+	fields["password"] = u.Password
+	return json.Marshal(fields)
+}
+
+// RetrieveOptions holds the optional settings of RetrieveToken.
+type RetrieveOptions struct {
+	// Retry, if non-nil, makes RetrieveToken retry transient failures.
+	Retry *RetryPolicy
+
+	// LoginFields are added to the user object of the login request.
+	LoginFields map[string]interface{}
+
+	// Location is the time zone of expiry times without a UTC offset.
+	// If nil, UTC is used.
+	Location *time.Location
+
+	// Clock tells the time for clock skew correction and retry waits.
+	// If nil, the system clock is used.
+	Clock Clock
+}
+
+// Clock tells the current time and signals when a duration has elapsed.
+// It is mirrored by geoauth.Clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) (c <-chan time.Time, stop func() bool)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
+
+// clock returns the clock of opts, or the system clock.
+func (opts *RetrieveOptions) clock() Clock {
+	if opts == nil || opts.Clock == nil {
+		return systemClock{}
+	}
+	return opts.Clock
+}
+
+// RetrieveToken logs in to the GEO authentication endpoint authURL with
+// email and password and returns the resulting token. A nil opts makes
+// a single attempt.
+func RetrieveToken(ctx context.Context, email, password, authURL string, opts *RetrieveOptions) (*Token, error) {
+	var policy *RetryPolicy
+	if opts != nil {
+		policy = opts.Retry
+	}
+	for attempt := 1; ; attempt++ {
+		token, err := retrieveToken(ctx, email, password, authURL, opts)
+		if err == nil {
+			return token, nil
+		}
+		wait, retry := policy.backoff(ctx, opts.clock(), attempt, err)
+		if !retry {
+			return token, withAttempts(err, attempt)
+		}
+		if err := sleep(ctx, opts.clock(), wait); err != nil {
+			return nil, withAttempts(err, attempt)
+		}
+	}
+}
+
+// retrieveToken makes a single login attempt.
+func retrieveToken(ctx context.Context, email, password, authURL string, opts *RetrieveOptions) (*Token, error) {
+	var (
+		extra map[string]interface{}
+		loc   *time.Location
+	)
+	if opts != nil {
+		extra, loc = opts.LoginFields, opts.Location
+	}
+	payload, err := json.Marshal(&loginRequest{
+		User: loginUser{Email: email, Password: password, Extra: extra},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, authURL, bytes.NewReader(payload))
 	if err != nil {
 		return nil, err
 	}
@@ -56,31 +192,55 @@ func RetrieveToken(ctx context.Context, email, password, authURL string) (*Token
 	if err != nil {
 		return nil, err
 	}
+	now := opts.clock().Now()
 	defer r.Body.Close()
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return nil, err
 	}
 	if code := r.StatusCode; code < 200 || code > 299 {
+		var errJSON struct {
+			StatusMessage string `json:"statusMessage"`
+		}
+		// The body is kept as is if it is not a GEO error.
+		json.Unmarshal(body, &errJSON)
 		return nil, &RetrieveError{
-			Response: r,
-			Body:     body,
+			Response:      r,
+			Body:          body,
+			Attempts:      1,
+			StatusMessage: errJSON.StatusMessage,
 		}
 	}
 
 	var authToken struct {
-		Tok tokenJSON `json:"authenticationToken"`
+		Tok json.RawMessage `json:"authenticationToken"`
 	}
 	if err = json.Unmarshal(body, &authToken); err != nil {
 		return nil, err
 	}
+	var tj tokenJSON
+	var raw map[string]interface{}
+	if len(authToken.Tok) > 0 {
+		if err = json.Unmarshal(authToken.Tok, &tj); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(authToken.Tok, &raw); err != nil {
+			return nil, err
+		}
+	}
 	token := &Token{
-		AccessToken: authToken.Tok.Token,
+		AccessToken: tj.Token,
+		ID:          tj.ID,
+		Type:        tj.Type,
+		UserID:      tj.UserID,
+		Raw:         raw,
 	}
-	token.Expiry, err = authToken.Tok.expiry()
+	token.Expiry, err = tj.expiry(loc)
 	if err != nil {
 		return nil, err
 	}
+	// Express the expiry in terms of the local clock.
+	token.Expiry = token.Expiry.Add(-clockSkew(r, now))
 	// Don't overwrite `AccessToken` with an empty value
 	// if this was a token refreshing request.
 	if token.AccessToken == "" {
@@ -89,11 +249,28 @@ func RetrieveToken(ctx context.Context, email, password, authURL string) (*Token
 	return token, nil
 }
 
+// withAttempts records the number of attempts made in err.
+func withAttempts(err error, attempts int) error {
+	if attempts == 1 {
+		return err
+	}
+	if rErr, ok := err.(*RetrieveError); ok {
+		rErr.Attempts = attempts
+		return rErr
+	}
+	return fmt.Errorf("cannot fetch token after %d attempts: %w", attempts, err)
+}
+
 type RetrieveError struct {
-	Response *http.Response
-	Body     []byte
+	Response      *http.Response
+	Body          []byte
+	Attempts      int
+	StatusMessage string
 }
 
 func (r *RetrieveError) Error() string {
+	if r.Attempts > 1 {
+		return fmt.Sprintf("cannot fetch token after %d attempts: %v\nResponse: %s", r.Attempts, r.Response.Status, r.Body)
+	}
 	return fmt.Sprintf("cannot fetch token %v\nResponse: %s", r.Response.Status, r.Body)
 }
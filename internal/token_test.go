@@ -2,10 +2,13 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestRetrieveTokenWithContexts(t *testing.T) {
@@ -22,7 +25,7 @@ func TestRetrieveTokenWithContexts(t *testing.T) {
 	}))
 	defer ts.Close()
 
-	_, err := RetrieveToken(context.Background(), clientID, "", ts.URL)
+	_, err := RetrieveToken(context.Background(), clientID, "", ts.URL, nil)
 	if err != nil {
 		t.Errorf("RetrieveToken (with background context) = %v; want no error", err)
 	}
@@ -35,9 +38,102 @@ func TestRetrieveTokenWithContexts(t *testing.T) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
-	_, err = RetrieveToken(ctx, clientID, "", cancellingts.URL)
+	_, err = RetrieveToken(ctx, clientID, "", cancellingts.URL, nil)
 	close(retrieved)
 	if err == nil {
 		t.Errorf("RetrieveToken (with cancelled context) = nil; want error)")
 	}
 }
+
+func TestRetrieveTokenLoginPayload(t *testing.T) {
+	passwords := []string{
+		`plain`,
+		`quote " and backslash \ `,
+		"control \x00\x01\x1f\t\n characters",
+		"non-BMP \U0001F600 \U0001D11E runes",
+		"separators \u2028 \u2029",
+		`go escapes \x41 A \a`,
+		`<html> & "entities"`,
+	}
+	for _, password := range passwords {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				User map[string]interface{} `json:"user"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("invalid login payload for %q: %v", password, err)
+			}
+			if got, want := req.User["password"], password; got != want {
+				t.Errorf("password = %q; want %q", got, want)
+			}
+			if got, want := req.User["email"], "client-id"; got != want {
+				t.Errorf("email = %q; want %q", got, want)
+			}
+			if got, want := req.User["deviceName"], "cron"; got != want {
+				t.Errorf("deviceName = %q; want %q", got, want)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"authenticationToken": {"token": "ACCESS_TOKEN", "expiresAt": "2018-02-01T08:37:49.3844879"}}`)
+		}))
+		opts := &RetrieveOptions{
+			LoginFields: map[string]interface{}{
+				"deviceName": "cron",
+				"password":   "cannot override",
+			},
+		}
+		if _, err := RetrieveToken(context.Background(), "client-id", password, ts.URL, opts); err != nil {
+			t.Errorf("RetrieveToken (%q) = %v; want no error", password, err)
+		}
+		ts.Close()
+	}
+}
+
+func TestTokenJSONExpiry(t *testing.T) {
+	aest := time.FixedZone("AEST", 10*60*60)
+	want := time.Date(2018, 2, 1, 8, 37, 49, 384487900, time.UTC)
+	tests := []struct {
+		expiresAt string
+		loc       *time.Location
+		want      time.Time
+	}{
+		{expiresAt: "2018-02-01T08:37:49.3844879", loc: nil, want: want},
+		{expiresAt: "2018-02-01T18:37:49.3844879", loc: aest, want: want},
+		{expiresAt: "2018-02-01T08:37:49.3844879Z", loc: aest, want: want},
+		{expiresAt: "2018-02-01T18:37:49.3844879+10:00", loc: nil, want: want},
+		{expiresAt: "2018-02-01T08:37:49Z", loc: nil, want: want.Truncate(time.Second)},
+	}
+	for _, tt := range tests {
+		tj := &tokenJSON{ExpiresAt: tt.expiresAt}
+		got, err := tj.expiry(tt.loc)
+		if err != nil {
+			t.Errorf("expiry(%q) = %v; want no error", tt.expiresAt, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("expiry(%q) = %v; want %v", tt.expiresAt, got, tt.want)
+		}
+	}
+	if _, err := (&tokenJSON{ExpiresAt: "tomorrow"}).expiry(nil); err == nil {
+		t.Errorf("expiry(%q) = nil; want error", "tomorrow")
+	}
+}
+
+func TestRetrieveTokenClockSkew(t *testing.T) {
+	const skew = time.Hour
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverNow := time.Now().Add(skew)
+		w.Header().Set("Date", serverNow.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"authenticationToken": {"token": "ACCESS_TOKEN", "expiresAt": %q}}`,
+			serverNow.Add(time.Hour).Format(time.RFC3339Nano))
+	}))
+	defer ts.Close()
+
+	token, err := RetrieveToken(context.Background(), "client-id", "", ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetime := time.Until(token.Expiry); lifetime < 59*time.Minute || lifetime > time.Hour+maxIgnoredSkew {
+		t.Errorf("token lifetime = %v; want about 1h", lifetime)
+	}
+}
@@ -0,0 +1,166 @@
+package geoauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/benkim0414/geoauth/internal"
+)
+
+// defaultKMSProvider is used by configs without a Decrypter so that its
+// KMS client is shared between them.
+var defaultKMSProvider = &KMSProvider{}
+
+// KMSProvider is a SecretDecrypter and SecretEncrypter backed by AWS
+// KMS. Encrypted secrets are base64-encoded KMS ciphertext blobs.
+//
+// The zero value uses the default AWS configuration in us-east-1.
+// The underlying KMS client is created on first use and reused for
+// subsequent calls, so the fields must not be modified afterwards.
+type KMSProvider struct {
+	// Region is the AWS region of the key. If empty, us-east-1 is used.
+	Region string
+
+	// Profile is the shared config profile to load AWS credentials
+	// from. If empty, the AWS SDK's default profile selection applies.
+	Profile string
+
+	// Endpoint optionally overrides the KMS endpoint URL, e.g. to
+	// point at a local KMS stand-in.
+	Endpoint string
+
+	// AccessKeyID and SecretAccessKey optionally set static AWS
+	// credentials, which take precedence over those of Profile and the
+	// default AWS configuration. The shared AWS configuration files are
+	// then not read.
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// KeyID identifies the KMS key protecting the secrets. It is
+	// required for encryption; decryption does not need it, as KMS
+	// identifies the key from the ciphertext.
+	KeyID string
+
+	// EncryptionContext is the additional authenticated data the
+	// secrets were encrypted with.
+	EncryptionContext map[string]string
+
+	mu  sync.Mutex
+	svc *kms.KMS
+}
+
+// DecryptSecret decrypts the base64-encoded ciphertext secret with AWS
+// KMS. Errors are reported as a *DecryptError.
+func (p *KMSProvider) DecryptSecret(ctx context.Context, secret string) (string, error) {
+	svc, err := p.client()
+	if err != nil {
+		return "", decryptErrorFromInternal(err)
+	}
+	plaintext, err := internal.DecryptSecret(ctx, svc, secret, p.EncryptionContext)
+	if err != nil {
+		return "", decryptErrorFromInternal(err)
+	}
+	return plaintext, nil
+}
+
+// EncryptSecret encrypts the plaintext secret under p.KeyID with AWS KMS
+// and returns the base64-encoded ciphertext blob.
+func (p *KMSProvider) EncryptSecret(ctx context.Context, plaintext string) (string, error) {
+	if p.KeyID == "" {
+		return "", errNoKeyID
+	}
+	svc, err := p.client()
+	if err != nil {
+		if dErr, ok := err.(*internal.DecryptError); ok {
+			err = dErr.Err
+		}
+		return "", fmt.Errorf("cannot encrypt secret: %w", err)
+	}
+	ciphertext, err := internal.EncryptSecret(ctx, svc, p.KeyID, plaintext, p.EncryptionContext)
+	if err != nil {
+		return "", fmt.Errorf("cannot encrypt secret: %w", err)
+	}
+	return ciphertext, nil
+}
+
+// errNoKeyID is returned by EncryptSecret if the provider has no KeyID.
+var errNoKeyID = errors.New("KMSProvider.KeyID is required for encryption")
+
+// client returns the KMS client, creating it on first use. A client
+// that failed to be created is attempted again on the next call.
+func (p *KMSProvider) client() (*kms.KMS, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.svc == nil {
+		svc, err := internal.NewKMSClient(internal.KMSConfig{
+			Region:   p.Region,
+			Profile:  p.Profile,
+			Endpoint: p.Endpoint,
+
+			AccessKeyID:     p.AccessKeyID,
+			SecretAccessKey: p.SecretAccessKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		p.svc = svc
+	}
+	return p.svc, nil
+}
+
+// DecryptErrorKind classifies why a secret could not be decrypted.
+type DecryptErrorKind = internal.DecryptErrorKind
+
+const (
+	// DecryptUnknown is any failure not covered by the other kinds,
+	// such as a network error or a disabled key.
+	DecryptUnknown = internal.DecryptUnknown
+
+	// DecryptConfigLoad means the AWS configuration or credentials
+	// could not be loaded.
+	DecryptConfigLoad = internal.DecryptConfigLoad
+
+	// DecryptBase64 means the secret is not valid base64.
+	DecryptBase64 = internal.DecryptBase64
+
+	// DecryptAccessDenied means the credentials are not allowed to
+	// use the key.
+	DecryptAccessDenied = internal.DecryptAccessDenied
+
+	// DecryptInvalidCiphertext means the secret is not a ciphertext
+	// of the key, or the encryption context does not match.
+	DecryptInvalidCiphertext = internal.DecryptInvalidCiphertext
+)
+
+// DecryptError is the error returned when a client secret cannot be
+// decrypted.
+type DecryptError struct {
+	// Kind classifies the failure.
+	Kind DecryptErrorKind
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *DecryptError) Error() string {
+	return fmt.Sprintf("cannot decrypt secret: %v: %v", e.Kind, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *DecryptError) Unwrap() error {
+	return e.Err
+}
+
+// decryptErrorFromInternal maps an *internal.DecryptError into a
+// *DecryptError. Other errors are returned as is.
+func decryptErrorFromInternal(err error) error {
+	if dErr, ok := err.(*internal.DecryptError); ok {
+		return &DecryptError{
+			Kind: dErr.Kind,
+			Err:  dErr.Err,
+		}
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package geoauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newKMSErrorServer(code string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"__type": %q, "message": "rejected"}`, code)
+	}))
+}
+
+func TestKMSProviderDecryptErrorKind(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+	secret := base64.StdEncoding.EncodeToString([]byte("CIPHERTEXT"))
+
+	tests := []struct {
+		name   string
+		code   string
+		secret string
+		want   DecryptErrorKind
+	}{
+		{name: "base64", code: "", secret: "not base64!", want: DecryptBase64},
+		{name: "access denied", code: "AccessDeniedException", secret: secret, want: DecryptAccessDenied},
+		{name: "invalid ciphertext", code: "InvalidCiphertextException", secret: secret, want: DecryptInvalidCiphertext},
+		{name: "disabled", code: "DisabledException", secret: secret, want: DecryptUnknown},
+	}
+	for _, tt := range tests {
+		ts := newKMSErrorServer(tt.code)
+		p := &KMSProvider{Endpoint: ts.URL}
+		_, err := p.DecryptSecret(context.Background(), tt.secret)
+		ts.Close()
+		var dErr *DecryptError
+		if !errors.As(err, &dErr) {
+			t.Errorf("DecryptSecret (%q) error = %v; want *DecryptError", tt.name, err)
+			continue
+		}
+		if got, want := dErr.Kind, tt.want; got != want {
+			t.Errorf("DecryptError.Kind (%q) = %v; want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestKMSCredentialsTokenDecryptError(t *testing.T) {
+	// A missing CA bundle makes loading the AWS config fail.
+	t.Setenv("AWS_CA_BUNDLE", "testdata/missing-ca-bundle.pem")
+	conf := newConf("")
+	conf.Decrypter = &KMSProvider{}
+	_, err := conf.KMSCredentialsToken(context.Background())
+	var dErr *DecryptError
+	if !errors.As(err, &dErr) {
+		t.Fatalf("KMSCredentialsToken error = %v; want *DecryptError", err)
+	}
+	if got, want := dErr.Kind, DecryptConfigLoad; got != want {
+		t.Errorf("DecryptError.Kind = %v; want %v", got, want)
+	}
+}
+
+func TestKMSProviderEncryptSecret(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "SECRET")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			KeyId     string
+			Plaintext []byte
+		}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			t.Error(err)
+			return
+		}
+		if got, want := in.KeyId, "alias/geo"; got != want {
+			t.Errorf("KeyId = %q; want %q", got, want)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		json.NewEncoder(w).Encode(map[string][]byte{"CiphertextBlob": append([]byte("SEALED:"), in.Plaintext...)})
+	}))
+	defer ts.Close()
+
+	p := &KMSProvider{Endpoint: ts.URL, KeyID: "alias/geo"}
+	secret, err := p.EncryptSecret(context.Background(), "PLAINTEXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := secret, base64.StdEncoding.EncodeToString([]byte("SEALED:PLAINTEXT")); got != want {
+		t.Errorf("EncryptSecret = %q; want %q", got, want)
+	}
+
+	if _, err := (&KMSProvider{Endpoint: ts.URL}).EncryptSecret(context.Background(), "PLAINTEXT"); err != errNoKeyID {
+		t.Errorf("EncryptSecret without KeyID error = %v; want %v", err, errNoKeyID)
+	}
+}
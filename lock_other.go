@@ -0,0 +1,21 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package geoauth
+
+import (
+	"context"
+	"os"
+)
+
+// lockFile does nothing on platforms without flock. Concurrent processes
+// still see whole files, as they are replaced atomically, but may each
+// log in and overwrite each other's tokens.
+func lockFile(ctx context.Context, f *os.File, exclusive bool) error {
+	return nil
+}
+
+// unlockFile does nothing on platforms without flock.
+func unlockFile(f *os.File) error {
+	return nil
+}
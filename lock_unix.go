@@ -0,0 +1,53 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package geoauth
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// maxLockPollInterval bounds the interval at which lockFile retries a
+// lock held by another process.
+const maxLockPollInterval = 100 * time.Millisecond
+
+// lockFile places an advisory lock on f, waiting for conflicting locks
+// held by other processes to be released. As flock cannot be
+// interrupted, the lock is polled for until ctx is done.
+func lockFile(ctx context.Context, f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	interval := time.Millisecond
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		switch err {
+		case nil:
+			return nil
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+		default:
+			return err
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		if interval *= 2; interval > maxLockPollInterval {
+			interval = maxLockPollInterval
+		}
+	}
+}
+
+// unlockFile releases the lock placed on f by lockFile.
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,73 @@
+package geoauth
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// ProfileEnvVar is the environment variable selecting the profile
+	// of a credentials file with named profiles read by
+	// FindDefaultConfig.
+	ProfileEnvVar = "GEO_PROFILE"
+
+	// DefaultProfile is the name of the profile used when no other is
+	// selected, and the name under which the credentials of a file
+	// without profiles are found.
+	DefaultProfile = "default"
+)
+
+// profilesJSON is the format of a geo_credentials.json file with named
+// profiles. The credentials at the top level, as in a file without
+// profiles, form the DefaultProfile unless profiles has one of that
+// name.
+type profilesJSON struct {
+	credentialsJSON
+	DefaultProfile string                      `json:"default_profile,omitempty"`
+	Profiles       map[string]*credentialsJSON `json:"profiles,omitempty"`
+}
+
+// ConfigFromProfile uses the profile called name of a geo_credentials.json
+// file to construct a config. Each profile holds the same fields as a
+// file without profiles, which ConfigFromJSON reads:
+//
+//	{
+//		"default_profile": "production",
+//		"profiles": {
+//			"production": {"client_id": "...", "client_secret": "..."},
+//			"local": {"client_id": "...", "client_secret": "...", "environment": "local"}
+//		}
+//	}
+//
+// If name is empty, the profile named by default_profile is used, and
+// then DefaultProfile. A file without profiles only has DefaultProfile.
+func ConfigFromProfile(jsonKey []byte, name string) (*Config, error) {
+	return configFromProfile(jsonKey, name, "")
+}
+
+// configFromProfile is like ConfigFromProfile, but if name is empty and
+// the file has named profiles, the profile called selected is used
+// before the one named by default_profile.
+func configFromProfile(jsonKey []byte, name, selected string) (*Config, error) {
+	var f profilesJSON
+	if err := json.Unmarshal(jsonKey, &f); err != nil {
+		return nil, err
+	}
+	if name == "" && len(f.Profiles) > 0 {
+		name = selected
+		if name == "" {
+			name = f.DefaultProfile
+		}
+	}
+	if name == "" {
+		name = DefaultProfile
+	}
+	cred := f.Profiles[name]
+	if cred == nil && name == DefaultProfile && (len(f.Profiles) == 0 || f.ClientID != "") {
+		cred = &f.credentialsJSON
+	}
+	if cred == nil {
+		return nil, fmt.Errorf("credentials profile %q not found", name)
+	}
+	return configFromCredentials(cred)
+}
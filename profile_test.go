@@ -0,0 +1,66 @@
+package geoauth
+
+import "testing"
+
+const profilesJSONKey = `{
+	"default_profile": "production",
+	"profiles": {
+		"production": {"client_id": "PRODUCTION_CLIENT_ID", "client_secret": "PRODUCTION_SECRET"},
+		"local": {"client_id": "LOCAL_CLIENT_ID", "client_secret": "LOCAL_SECRET", "environment": "local"}
+	}
+}`
+
+func TestConfigFromProfile(t *testing.T) {
+	flat := `{"client_id": "CLIENT_ID", "client_secret": "CLIENT_SECRET"}`
+	mixed := `{"client_id": "CLIENT_ID", "profiles": {"test": {"client_id": "TEST_CLIENT_ID"}}}`
+	noDefault := `{"profiles": {"test": {"client_id": "TEST_CLIENT_ID"}}}`
+
+	tests := []struct {
+		name     string
+		jsonKey  string
+		profile  string
+		selected string
+		clientID string // empty if an error is expected
+	}{
+		{name: "flat", jsonKey: flat, clientID: "CLIENT_ID"},
+		{name: "flat default", jsonKey: flat, profile: DefaultProfile, clientID: "CLIENT_ID"},
+		{name: "flat ignores selected", jsonKey: flat, selected: "local", clientID: "CLIENT_ID"},
+		{name: "flat named", jsonKey: flat, profile: "local"},
+		{name: "default_profile", jsonKey: profilesJSONKey, clientID: "PRODUCTION_CLIENT_ID"},
+		{name: "named", jsonKey: profilesJSONKey, profile: "local", clientID: "LOCAL_CLIENT_ID"},
+		{name: "selected", jsonKey: profilesJSONKey, selected: "local", clientID: "LOCAL_CLIENT_ID"},
+		{name: "named over selected", jsonKey: profilesJSONKey, profile: "production", selected: "local", clientID: "PRODUCTION_CLIENT_ID"},
+		{name: "missing", jsonKey: profilesJSONKey, profile: "test"},
+		{name: "mixed top level", jsonKey: mixed, clientID: "CLIENT_ID"},
+		{name: "mixed named", jsonKey: mixed, profile: "test", clientID: "TEST_CLIENT_ID"},
+		{name: "no default", jsonKey: noDefault},
+		{name: "null profile", jsonKey: `{"profiles": {"test": null}}`, profile: "test"},
+	}
+	for _, tt := range tests {
+		conf, err := configFromProfile([]byte(tt.jsonKey), tt.profile, tt.selected)
+		if tt.clientID == "" {
+			if err == nil {
+				t.Errorf("ConfigFromProfile (%q) = %+v; want error", tt.name, conf)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ConfigFromProfile (%q) error = %v", tt.name, err)
+			continue
+		}
+		if got, want := conf.ClientID, tt.clientID; got != want {
+			t.Errorf("ConfigFromProfile (%q) ClientID = %q; want %q", tt.name, got, want)
+		}
+	}
+}
+
+func TestConfigFromJSONProfiles(t *testing.T) {
+	t.Setenv(ProfileEnvVar, "local")
+	conf, err := ConfigFromJSON([]byte(profilesJSONKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ClientID != "PRODUCTION_CLIENT_ID" || conf.ClientSecret != "PRODUCTION_SECRET" {
+		t.Errorf("ConfigFromJSON = %+v; want the production profile", conf)
+	}
+}
@@ -0,0 +1,25 @@
+package geoauth
+
+import "time"
+
+// RetryPolicy configures the retrying of logins that fail transiently:
+// timeouts, temporary DNS failures, reset connections and 408, 429, 500,
+// 502, 503 and 504 responses. Rejected credentials, unknown hosts and
+// refused connections are never retried. The wait before each retry
+// doubles from MinBackoff up to MaxBackoff, with random jitter, unless
+// a 429 or 503 response carries a Retry-After header, which is honoured
+// instead. If the server asks to wait longer than MaxBackoff, no further
+// attempt is made.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of login attempts, including
+	// the first one. Values below 2 disable retries.
+	MaxAttempts int
+
+	// MinBackoff is the wait before the first retry.
+	// If zero, 100 milliseconds is used.
+	MinBackoff time.Duration
+
+	// MaxBackoff is the longest wait between two attempts.
+	// If zero, 10 seconds is used.
+	MaxBackoff time.Duration
+}
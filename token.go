@@ -2,8 +2,11 @@ package geoauth
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/benkim0414/geoauth/internal"
@@ -23,6 +26,45 @@ type Token struct {
 
 	// Expiry is the optional expiration time of the access token.
 	Expiry time.Time
+
+	// SessionID is the ID of the GEO session the token belongs to.
+	SessionID string
+
+	// TokenType is the type of the GEO session.
+	TokenType string
+
+	// UserID is the ID of the GEO user the token was issued to.
+	UserID string
+
+	// raw optionally contains the fields of the authenticationToken
+	// object returned by the server.
+	raw *rawFields
+
+	// clock optionally tells the time for Valid. If nil, the system
+	// clock is used.
+	clock Clock
+}
+
+// rawFields holds the fields of an authenticationToken object. Token
+// refers to it through a pointer so that Token values stay comparable.
+type rawFields struct {
+	m map[string]interface{}
+}
+
+// newRawFields returns the rawFields holding m, or nil if m is nil.
+func newRawFields(m map[string]interface{}) *rawFields {
+	if m == nil {
+		return nil
+	}
+	return &rawFields{m: m}
+}
+
+// fields returns the fields held by r, or nil if r is nil.
+func (r *rawFields) fields() map[string]interface{} {
+	if r == nil {
+		return nil
+	}
+	return r.m
 }
 
 // SetAuthHeader sets the Authorization header to r using the access
@@ -31,27 +73,114 @@ func (t *Token) SetAuthHeader(r *http.Request) {
 	r.Header.Set("Authorization", "token "+t.AccessToken)
 }
 
+// Extra returns an extra field of the authenticationToken object the
+// token was parsed from, or nil if there is no such field.
+func (t *Token) Extra(key string) interface{} {
+	return t.raw.fields()[key]
+}
+
 // expired reports whether the token is expired.
 func (t *Token) expired() bool {
+	return t.expiredAt(clockOrSystem(t.clock).Now())
+}
+
+// expiredAt reports whether the token is expired at now.
+func (t *Token) expiredAt(now time.Time) bool {
 	if t.Expiry.IsZero() {
 		return false
 	}
-	return t.Expiry.Round(0).Add(-expiryDelta).Before(time.Now())
+	return t.Expiry.Round(0).Add(-expiryDelta).Before(now)
 }
 
 // Valid reporets whether t is non-nil, has an AccessToken, and is not expired.
+// Tokens obtained through a Config with a Clock expire according to it.
 func (t *Token) Valid() bool {
 	return t != nil && t.AccessToken != "" && !t.expired()
 }
 
-// tokenFromInternal maps an *internal.Token struct into a *Token struct.
-func tokenFromInternal(t *internal.Token) *Token {
+// validAt reports whether t is non-nil, has an AccessToken, and is not
+// expired at now.
+func (t *Token) validAt(now time.Time) bool {
+	return t != nil && t.AccessToken != "" && !t.expiredAt(now)
+}
+
+// tokenJSONVersion is the version of the JSON encoding of a Token.
+const tokenJSONVersion = 1
+
+// tokenJSON is the JSON encoding of a Token. Fields may be added within
+// a version; other changes need a new version.
+type tokenJSON struct {
+	Version     int                    `json:"version"`
+	AccessToken string                 `json:"access_token"`
+	Expiry      string                 `json:"expiry,omitempty"` // RFC 3339
+	SessionID   string                 `json:"session_id,omitempty"`
+	TokenType   string                 `json:"token_type,omitempty"`
+	UserID      string                 `json:"user_id,omitempty"`
+	Raw         map[string]interface{} `json:"raw,omitempty"`
+}
+
+// MarshalJSON encodes t, including its session metadata and the extra
+// fields returned by Extra, in a versioned format that UnmarshalJSON
+// decodes. The expiry is encoded in RFC 3339 with nanoseconds and
+// omitted if zero.
+//
+// Tokens can thus be stored or passed to other processes and restored
+// with ReuseTokenSource.
+func (t Token) MarshalJSON() ([]byte, error) {
+	tj := tokenJSON{
+		Version:     tokenJSONVersion,
+		AccessToken: t.AccessToken,
+		SessionID:   t.SessionID,
+		TokenType:   t.TokenType,
+		UserID:      t.UserID,
+		Raw:         t.raw.fields(),
+	}
+	if !t.Expiry.IsZero() {
+		tj.Expiry = t.Expiry.Format(time.RFC3339Nano)
+	}
+	return json.Marshal(&tj)
+}
+
+// UnmarshalJSON decodes a token encoded by MarshalJSON. Tokens encoded
+// in an unknown version are rejected.
+func (t *Token) UnmarshalJSON(b []byte) error {
+	var tj tokenJSON
+	if err := json.Unmarshal(b, &tj); err != nil {
+		return err
+	}
+	if tj.Version != tokenJSONVersion {
+		return fmt.Errorf("unsupported token version %d", tj.Version)
+	}
+	var expiry time.Time
+	if tj.Expiry != "" {
+		var err error
+		if expiry, err = time.Parse(time.RFC3339Nano, tj.Expiry); err != nil {
+			return err
+		}
+	}
+	t.AccessToken = tj.AccessToken
+	t.Expiry = expiry
+	t.SessionID = tj.SessionID
+	t.TokenType = tj.TokenType
+	t.UserID = tj.UserID
+	t.raw = newRawFields(tj.Raw)
+	return nil
+}
+
+// tokenFromInternal maps an *internal.Token struct into a *Token struct
+// telling the time with clock.
+func tokenFromInternal(t *internal.Token, clock Clock) *Token {
 	if t == nil {
 		return nil
 	}
 	return &Token{
+		clock:       clock,
 		AccessToken: t.AccessToken,
 		Expiry:      t.Expiry,
+		SessionID:   t.ID,
+		TokenType:   t.Type,
+		UserID:      t.UserID,
+		raw:         newRawFields(t.Raw),
 	}
 }
 
@@ -59,14 +188,23 @@ func tokenFromInternal(t *internal.Token) *Token {
 // This token is then mapped from *internal.Token into an *geoauth.Token
 // which is returned along with an error.
 func retrieveToken(ctx context.Context, c *Config) (*Token, error) {
-	tk, err := internal.RetrieveToken(ctx, c.ClientID, c.ClientSecret, c.AuthURL)
+	authURL := c.authURL()
+	if authURL == "" {
+		return nil, unknownEnvironmentError(string(c.Environment))
+	}
+	tk, err := internal.RetrieveToken(ctx, c.ClientID, c.ClientSecret, authURL, &internal.RetrieveOptions{
+		Retry:       (*internal.RetryPolicy)(c.Retry),
+		LoginFields: c.LoginFields,
+		Location:    c.ExpiryLocation,
+		Clock:       c.Clock,
+	})
 	if err != nil {
 		if rErr, ok := err.(*internal.RetrieveError); ok {
 			return nil, (*RetrieveError)(rErr)
 		}
 		return nil, err
 	}
-	return tokenFromInternal(tk), nil
+	return tokenFromInternal(tk, c.Clock), nil
 }
 
 // RetrieveError is the error returned when the token endpoint returns a
@@ -76,8 +214,66 @@ type RetrieveError struct {
 	// Body is the body that was consumed by reading Response.Body.
 	// It may be truncated.
 	Body []byte
+	// Attempts is the number of login attempts made, including
+	// retries under Config.Retry.
+	Attempts int
+	// StatusMessage is the message of the GEO error body, such as
+	// "Invalid email or password". It is empty if the body is not a
+	// GEO error.
+	StatusMessage string
 }
 
+var (
+	// ErrInvalidCredentials matches a RetrieveError for a login rejected
+	// because of a wrong email or password.
+	ErrInvalidCredentials = errors.New("invalid email or password")
+
+	// ErrAccountLocked matches a RetrieveError for a login rejected
+	// because the account is locked.
+	ErrAccountLocked = errors.New("account locked")
+
+	// ErrRateLimited matches a RetrieveError for a login rejected
+	// because of too many requests.
+	ErrRateLimited = errors.New("too many login requests")
+
+	// ErrServerUnavailable matches a RetrieveError for a login that
+	// failed because of a server error.
+	ErrServerUnavailable = errors.New("authentication server unavailable")
+)
+
 func (r *RetrieveError) Error() string {
+	if r.Attempts > 1 {
+		return fmt.Sprintf("cannot fetch token after %d attempts: %v\nResponse: %s", r.Attempts, r.Response.Status, r.Body)
+	}
 	return fmt.Sprintf("cannot fetch token: %v\nResponse: %s", r.Response.Status, r.Body)
 }
+
+// Is reports whether r is classified as target, one of
+// ErrInvalidCredentials, ErrAccountLocked, ErrRateLimited and
+// ErrServerUnavailable, for use with errors.Is.
+func (r *RetrieveError) Is(target error) bool {
+	switch target {
+	case ErrInvalidCredentials:
+		return r.invalidCredentials()
+	case ErrAccountLocked:
+		return r.accountLocked()
+	case ErrRateLimited:
+		return r.Response.StatusCode == http.StatusTooManyRequests
+	case ErrServerUnavailable:
+		return r.Response.StatusCode >= 500
+	}
+	return false
+}
+
+func (r *RetrieveError) invalidCredentials() bool {
+	switch r.Response.StatusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+		return !r.accountLocked()
+	}
+	return false
+}
+
+func (r *RetrieveError) accountLocked() bool {
+	return r.Response.StatusCode == http.StatusLocked ||
+		strings.Contains(strings.ToLower(r.StatusMessage), "locked")
+}
@@ -1,8 +1,16 @@
 package geoauth
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/benkim0414/geoauth/geoauthtest"
 )
 
 func TestTokenExpiry(t *testing.T) {
@@ -22,3 +30,152 @@ func TestTokenExpiry(t *testing.T) {
 		}
 	}
 }
+
+func TestRetrieveErrorIs(t *testing.T) {
+	sentinels := []error{ErrInvalidCredentials, ErrAccountLocked, ErrRateLimited, ErrServerUnavailable}
+	tests := []struct {
+		code int
+		body string
+		want error
+	}{
+		{code: http.StatusBadRequest, body: `{"statusMessage": "Invalid email or password"}`, want: ErrInvalidCredentials},
+		{code: http.StatusUnauthorized, body: ``, want: ErrInvalidCredentials},
+		{code: http.StatusForbidden, body: `{"statusMessage": "Account is locked"}`, want: ErrAccountLocked},
+		{code: http.StatusLocked, body: ``, want: ErrAccountLocked},
+		{code: http.StatusTooManyRequests, body: ``, want: ErrRateLimited},
+		{code: http.StatusBadGateway, body: `<html>Bad Gateway</html>`, want: ErrServerUnavailable},
+		{code: http.StatusNotFound, body: ``, want: nil},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.code)
+			w.Write([]byte(tt.body))
+		}))
+		_, err := newConf(ts.URL).PasswordCredentialsToken(context.Background())
+		ts.Close()
+		var rErr *RetrieveError
+		if !errors.As(err, &rErr) {
+			t.Errorf("error (%d) = %v; want *RetrieveError", tt.code, err)
+			continue
+		}
+		for _, target := range sentinels {
+			if got, want := errors.Is(err, target), target == tt.want; got != want {
+				t.Errorf("errors.Is(%d %s, %q) = %v; want %v", tt.code, tt.body, target, got, want)
+			}
+		}
+	}
+}
+
+func TestReuseTokenSourceClock(t *testing.T) {
+	clock := geoauthtest.NewFakeClock(time.Date(2018, 2, 1, 8, 0, 0, 0, time.UTC))
+	src := newSequenceTokenSource(clock, time.Minute)
+	rts := newReuseTokenSource(nil, src, clock)
+
+	assertToken(t, rts, "TOKEN_1")
+	clock.Advance(time.Minute - expiryDelta)
+	assertToken(t, rts, "TOKEN_1")
+	clock.Advance(time.Nanosecond)
+	assertToken(t, rts, "TOKEN_2")
+}
+
+func TestTokenValidClock(t *testing.T) {
+	clock := geoauthtest.NewFakeClock(time.Date(2018, 2, 1, 8, 0, 0, 0, time.UTC))
+	tok := &Token{AccessToken: "ACCESS_TOKEN", Expiry: clock.Now().Add(time.Minute), clock: clock}
+	if !tok.Valid() {
+		t.Errorf("got invalid before expiry; want valid")
+	}
+	clock.Advance(time.Minute)
+	if tok.Valid() {
+		t.Errorf("got valid after expiry; want invalid")
+	}
+}
+
+func TestTokenComparable(t *testing.T) {
+	a := Token{AccessToken: "ACCESS_TOKEN", raw: newRawFields(map[string]interface{}{"deviceName": "DEVICE"})}
+	b := a
+	if a != b {
+		t.Errorf("copy of %#v compares unequal", a)
+	}
+	if got, want := b.Extra("deviceName"), "DEVICE"; got != want {
+		t.Errorf("Extra(deviceName) = %v; want %v", got, want)
+	}
+}
+
+func TestTokenJSON(t *testing.T) {
+	loc := time.FixedZone("AEDT", 11*60*60)
+	tests := []struct {
+		name string
+		tok  *Token
+		json string
+	}{
+		{
+			name: "full",
+			tok: &Token{
+				AccessToken: "ACCESS_TOKEN",
+				Expiry:      time.Date(2018, 2, 1, 19, 0, 0, 123456789, loc),
+				SessionID:   "SESSION_ID",
+				TokenType:   "AuthenticationToken",
+				UserID:      "USER_ID",
+				raw:         newRawFields(map[string]interface{}{"deviceName": "DEVICE"}),
+			},
+			json: `{"version":1,"access_token":"ACCESS_TOKEN","expiry":"2018-02-01T19:00:00.123456789+11:00","session_id":"SESSION_ID","token_type":"AuthenticationToken","user_id":"USER_ID","raw":{"deviceName":"DEVICE"}}`,
+		},
+		{
+			name: "no expiry",
+			tok:  &Token{AccessToken: "ACCESS_TOKEN"},
+			json: `{"version":1,"access_token":"ACCESS_TOKEN"}`,
+		},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(tt.tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(b), tt.json; got != want {
+			t.Errorf("Marshal (%q) = %s; want %s", tt.name, got, want)
+		}
+		if b2, _ := json.Marshal(*tt.tok); string(b2) != string(b) {
+			t.Errorf("Marshal of a Token value (%q) = %s; want %s", tt.name, b2, b)
+		}
+
+		got := new(Token)
+		if err := json.Unmarshal(b, got); err != nil {
+			t.Fatal(err)
+		}
+		if !got.Expiry.Equal(tt.tok.Expiry) {
+			t.Errorf("Unmarshal (%q) Expiry = %v; want %v", tt.name, got.Expiry, tt.tok.Expiry)
+		}
+		got.Expiry = tt.tok.Expiry
+		if !reflect.DeepEqual(got, tt.tok) {
+			t.Errorf("Unmarshal (%q) = %#v; want %#v", tt.name, got, tt.tok)
+		}
+	}
+}
+
+func TestTokenUnmarshalJSONVersion(t *testing.T) {
+	for _, data := range []string{
+		`{"access_token":"ACCESS_TOKEN"}`,
+		`{"version":2,"access_token":"ACCESS_TOKEN"}`,
+	} {
+		var tok Token
+		if err := json.Unmarshal([]byte(data), &tok); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded; want error", data)
+		}
+	}
+	var tok Token
+	if err := json.Unmarshal([]byte(`{"version":1,"access_token":"ACCESS_TOKEN","expiry":"tomorrow"}`), &tok); err == nil {
+		t.Error("Unmarshal with an invalid expiry succeeded; want error")
+	}
+}
+
+func TestTokenJSONReuseTokenSource(t *testing.T) {
+	b, err := json.Marshal(&Token{AccessToken: "ACCESS_TOKEN", Expiry: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := new(Token)
+	if err := json.Unmarshal(b, tok); err != nil {
+		t.Fatal(err)
+	}
+	assertToken(t, ReuseTokenSource(tok, &tokenSource{&Token{AccessToken: "NEW_TOKEN"}}), "ACCESS_TOKEN")
+}
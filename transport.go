@@ -10,6 +10,11 @@ import (
 var (
 	// ErrNoTokenSource is returned if a transport has no token source.
 	ErrNoTokenSource = errors.New("no token source")
+
+	// ErrBodyNotReplayable is returned if the resource server rejects
+	// a token with 401 Unauthorized and the request cannot be sent again
+	// with a refreshed token because its body cannot be rewound.
+	ErrBodyNotReplayable = errors.New("request body cannot be replayed; set Request.GetBody")
 )
 
 // Transport is an http.RoundTripper that makes HTTP requests,
@@ -30,17 +35,60 @@ type Transport struct {
 
 // RoundTrip authorizes and authenticates the request with an
 // access token. If no token exists or token is expired,
-// tries to refresh/fetch a new token.
+// tries to refresh/fetch a new token. If Source implements
+// TokenSourceWithContext, the request's context bounds the wait
+// for the token.
+//
+// If the resource server responds with 401 Unauthorized and Source
+// caches its tokens (as the sources returned by ReuseTokenSource and
+// Config.TokenSource do), the cached token is discarded, a new one is
+// fetched and the request is sent once more. Requests with a body are
+// only replayed if Request.GetBody is set; otherwise
+// ErrBodyNotReplayable is returned, and the next request uses a new
+// token.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	if t.Source == nil {
 		return nil, ErrNoTokenSource
 	}
-	token, err := t.Source.Token()
+	token, err := tokenContext(req.Context(), t.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.roundTrip(req, req.Body, token)
+	if err != nil {
+		return nil, err
+	}
+	inv, ok := t.Source.(invalidator)
+	if !ok || res.StatusCode != http.StatusUnauthorized {
+		return res, nil
+	}
+
+	// The server has revoked the token before its expiry. Discard the
+	// response, drop the cached token and try again with a fresh one.
+	// The token is dropped even if the request cannot be replayed, so
+	// that later requests do not fail with it too.
+	res.Body.Close()
+	inv.invalidate(token)
+	body, err := rewindBody(req)
+	if err != nil {
+		return nil, err
+	}
+	token, err = tokenContext(req.Context(), t.Source)
 	if err != nil {
+		if body != nil {
+			body.Close()
+		}
 		return nil, err
 	}
+	return t.roundTrip(req, body, token)
+}
 
+// roundTrip sends a clone of req with the given body, authorized with
+// token, through the base RoundTripper.
+func (t *Transport) roundTrip(req *http.Request, body io.ReadCloser, token *Token) (*http.Response, error) {
 	req2 := cloneRequest(req)
+	req2.Body = body
 	token.SetAuthHeader(req2)
 	t.setModReq(req, req2)
 	res, err := t.base().RoundTrip(req2)
@@ -55,6 +103,26 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return res, nil
 }
 
+// rewindBody returns a fresh copy of the body of req so that it can be
+// sent again.
+func rewindBody(req *http.Request) (io.ReadCloser, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req.Body, nil
+	}
+	if req.GetBody == nil {
+		return nil, ErrBodyNotReplayable
+	}
+	return req.GetBody()
+}
+
+// invalidator is implemented by token sources that cache a token and
+// can be told to discard it, so that the next call to Token fetches a
+// new one.
+type invalidator interface {
+	// invalidate discards t if it is still the cached token.
+	invalidate(t *Token)
+}
+
 // CancelRequest cancels an in-flight request by closing its connection.
 func (t *Transport) CancelRequest(req *http.Request) {
 	type canceler interface {
@@ -1,10 +1,16 @@
 package geoauth
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/benkim0414/geoauth/geoauthtest"
 )
 
 type tokenSource struct{ token *Token }
@@ -50,6 +56,127 @@ func TestTransportTokenSource(t *testing.T) {
 	res.Body.Close()
 }
 
+// newEchoServer returns a fake GEO server whose resources echo the
+// request body.
+func newEchoServer() *geoauthtest.Server {
+	server := geoauthtest.NewServer()
+	server.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	return server
+}
+
+func TestTransportReplaysOnUnauthorized(t *testing.T) {
+	server := newEchoServer()
+	defer server.Close()
+	conf := newConf(server.LoginURL)
+	client := conf.Client(context.Background(), &Token{AccessToken: "REVOKED"})
+
+	res, err := client.Post(server.URL+"/resource", "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if got, want := res.StatusCode, http.StatusOK; got != want {
+		t.Fatalf("StatusCode = %d; want %d", got, want)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if got, want := string(body), "payload"; got != want {
+		t.Errorf("replayed body = %q; want %q", got, want)
+	}
+	if got, want := server.LoginCount(), 1; got != want {
+		t.Errorf("LoginCount = %d; want %d", got, want)
+	}
+}
+
+func TestTransportReplaysWithBackgroundTokenSource(t *testing.T) {
+	server := newEchoServer()
+	defer server.Close()
+	conf := newConf(server.LoginURL)
+	src := NewBackgroundTokenSource(conf.TokenSource(context.Background(), nil), nil)
+	defer src.Stop()
+	client := NewClient(context.Background(), src)
+
+	for i := 0; i < 2; i++ {
+		res, err := client.Post(server.URL+"/resource", "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got, want := res.StatusCode, http.StatusOK; got != want {
+			t.Fatalf("StatusCode (request %d) = %d; want %d", i+1, got, want)
+		}
+		server.RevokeAll()
+	}
+	if got, want := server.LoginCount(), 2; got != want {
+		t.Errorf("LoginCount = %d; want %d", got, want)
+	}
+}
+
+func TestTransportBodyNotReplayable(t *testing.T) {
+	server := newEchoServer()
+	defer server.Close()
+	conf := newConf(server.LoginURL)
+	tr := &Transport{Source: conf.TokenSource(context.Background(), &Token{AccessToken: "REVOKED"})}
+
+	req, err := http.NewRequest("POST", server.URL+"/resource", ioutil.NopCloser(strings.NewReader("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tr.RoundTrip(req)
+	if err != ErrBodyNotReplayable {
+		t.Errorf("RoundTrip error = %v; want %v", err, ErrBodyNotReplayable)
+	}
+}
+
+func TestTransportBodyNotReplayableDropsToken(t *testing.T) {
+	server := newEchoServer()
+	defer server.Close()
+	conf := newConf(server.LoginURL)
+	tr := &Transport{Source: conf.TokenSource(context.Background(), &Token{AccessToken: "REVOKED"})}
+
+	post := func() (*http.Response, error) {
+		req, err := http.NewRequest("POST", server.URL+"/resource", ioutil.NopCloser(strings.NewReader("payload")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tr.RoundTrip(req)
+	}
+	if _, err := post(); err != ErrBodyNotReplayable {
+		t.Fatalf("RoundTrip error = %v; want %v", err, ErrBodyNotReplayable)
+	}
+	// The rejected token is not used again.
+	res, err := post()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got, want := res.StatusCode, http.StatusOK; got != want {
+		t.Errorf("StatusCode = %d; want %d", got, want)
+	}
+	if got, want := server.LoginCount(), 1; got != want {
+		t.Errorf("LoginCount = %d; want %d", got, want)
+	}
+}
+
+func TestTransportUnauthorizedWithoutCache(t *testing.T) {
+	server := newEchoServer()
+	defer server.Close()
+	tr := &Transport{Source: &tokenSource{token: &Token{AccessToken: "REVOKED"}}}
+	client := &http.Client{Transport: tr}
+	res, err := client.Get(server.URL + "/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got, want := res.StatusCode, http.StatusUnauthorized; got != want {
+		t.Errorf("StatusCode = %d; want %d", got, want)
+	}
+	if got := server.LoginCount(); got != 0 {
+		t.Errorf("LoginCount = %d; want 0", got)
+	}
+}
+
 func TestTokenValidNoAccessToken(t *testing.T) {
 	token := &Token{}
 	if token.Valid() {
@@ -69,3 +196,22 @@ func TestExpiredWithExpiry(t *testing.T) {
 func newMockServer(handler func(w http.ResponseWriter, r *http.Request)) *httptest.Server {
 	return httptest.NewServer(http.HandlerFunc(handler))
 }
+
+func TestTransportRequestContextDeadline(t *testing.T) {
+	src := &blockingTokenSource{release: make(chan struct{})}
+	defer close(src.release)
+	server := newMockServer(func(w http.ResponseWriter, r *http.Request) {})
+	defer server.Close()
+	client := &http.Client{Transport: &Transport{Source: ReuseTokenSource(nil, src)}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Do(req.WithContext(ctx))
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("Do error = %v; want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,137 @@
+package geoauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ValidationError is the error returned by Config.Validate. It lists
+// every invalid field of the config.
+type ValidationError struct {
+	Fields []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, fErr := range e.Fields {
+		msgs[i] = fErr.Error()
+	}
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+// FieldError describes an invalid field of a Config.
+type FieldError struct {
+	// Field is the name of the field, such as "ClientID" or
+	// "Retry.MaxBackoff".
+	Field string
+	// Err describes what is wrong with the field.
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	errRequired        = errors.New("is required")
+	errNegative        = errors.New("must not be negative")
+	errInsecureAuthURL = errors.New("must use https, or http on localhost with AllowInsecureLocalhost")
+)
+
+// Validate reports whether c can be used to log in. If not, it returns a
+// *ValidationError naming each invalid field:
+//
+//   - ClientID and ClientSecret must not be empty.
+//   - The login URL, from AuthURL or Environment, must be an absolute
+//     https URL. Plain http is only accepted for localhost and loopback
+//     addresses, and only if AllowInsecureLocalhost is set. A URL
+//     derived from Environment is reported under that field.
+//   - The durations of Retry must not be negative, and MinBackoff must
+//     not exceed MaxBackoff.
+func (c *Config) Validate() error {
+	var errs []*FieldError
+	add := func(field string, err error) {
+		errs = append(errs, &FieldError{Field: field, Err: err})
+	}
+
+	if c.ClientID == "" {
+		add("ClientID", errRequired)
+	}
+	if c.ClientSecret == "" {
+		add("ClientSecret", errRequired)
+	}
+	urlField := "AuthURL"
+	if c.AuthURL == "" && c.Environment != "" {
+		urlField = "Environment"
+	}
+	if urlField == "Environment" && c.Environment.BaseURL() == "" {
+		add("Environment", unknownEnvironmentError(string(c.Environment)))
+	} else if err := c.validateAuthURL(); err != nil {
+		add(urlField, err)
+	}
+	if r := c.Retry; r != nil {
+		if r.MinBackoff < 0 {
+			add("Retry.MinBackoff", errNegative)
+		}
+		if r.MaxBackoff < 0 {
+			add("Retry.MaxBackoff", errNegative)
+		}
+		if r.MinBackoff > 0 && r.MaxBackoff > 0 && r.MinBackoff > r.MaxBackoff {
+			add("Retry.MinBackoff", errors.New("exceeds MaxBackoff"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Fields: errs}
+	}
+	return nil
+}
+
+func (c *Config) validateAuthURL() error {
+	u, err := url.Parse(c.authURL())
+	if err != nil {
+		return err
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return errors.New("must be an absolute URL")
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if c.AllowInsecureLocalhost && isLocalhost(u.Hostname()) {
+			return nil
+		}
+	}
+	return errInsecureAuthURL
+}
+
+// isLocalhost reports whether host names the local machine.
+func isLocalhost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// errorTokenSource is a TokenSource that always fails with err.
+type errorTokenSource struct {
+	err error
+}
+
+func (s errorTokenSource) Token() (*Token, error) {
+	return nil, s.err
+}
+
+func (s errorTokenSource) TokenContext(ctx context.Context) (*Token, error) {
+	return nil, s.err
+}
@@ -0,0 +1,91 @@
+package geoauth
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		conf   *Config
+		fields []string
+	}{
+		{name: "valid", conf: &Config{ClientID: "ID", ClientSecret: "SECRET"}},
+		{name: "empty", conf: &Config{}, fields: []string{"ClientID", "ClientSecret"}},
+		{name: "http", conf: &Config{ClientID: "ID", ClientSecret: "SECRET", AuthURL: "http://geo.example.com/login"}, fields: []string{"AuthURL"}},
+		{name: "relative", conf: &Config{ClientID: "ID", ClientSecret: "SECRET", AuthURL: "/api/session/login"}, fields: []string{"AuthURL"}},
+		{name: "localhost", conf: &Config{ClientID: "ID", ClientSecret: "SECRET", AuthURL: "http://localhost:3000/login"}, fields: []string{"AuthURL"}},
+		{name: "allowed localhost", conf: &Config{ClientID: "ID", ClientSecret: "SECRET", AuthURL: "http://127.0.0.1:3000/login", AllowInsecureLocalhost: true}},
+		{name: "local environment", conf: &Config{ClientID: "ID", ClientSecret: "SECRET", Environment: Local}, fields: []string{"Environment"}},
+		{name: "allowed local environment", conf: &Config{ClientID: "ID", ClientSecret: "SECRET", Environment: Local, AllowInsecureLocalhost: true}},
+		{name: "allowed remote http", conf: &Config{ClientID: "ID", ClientSecret: "SECRET", AuthURL: "http://geo.example.com/login", AllowInsecureLocalhost: true}, fields: []string{"AuthURL"}},
+		{name: "unknown environment", conf: &Config{ClientID: "ID", ClientSecret: "SECRET", Environment: "moon"}, fields: []string{"Environment"}},
+		{
+			name:   "retry",
+			conf:   &Config{ClientID: "ID", ClientSecret: "SECRET", Retry: &RetryPolicy{MinBackoff: time.Minute, MaxBackoff: time.Second}},
+			fields: []string{"Retry.MinBackoff"},
+		},
+	}
+	for _, tt := range tests {
+		err := tt.conf.Validate()
+		if tt.fields == nil {
+			if err != nil {
+				t.Errorf("Validate (%q) = %v; want nil", tt.name, err)
+			}
+			continue
+		}
+		var vErr *ValidationError
+		if !errors.As(err, &vErr) {
+			t.Errorf("Validate (%q) = %v; want *ValidationError", tt.name, err)
+			continue
+		}
+		var fields []string
+		for _, fErr := range vErr.Fields {
+			fields = append(fields, fErr.Field)
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("Validate (%q) fields = %q; want %q", tt.name, fields, tt.fields)
+		}
+	}
+}
+
+func TestConfigValidateError(t *testing.T) {
+	err := (&Config{AuthURL: "http://geo.example.com/login"}).Validate()
+	if got, want := err.Error(), "invalid config: ClientID: is required; ClientSecret: is required; AuthURL: "+errInsecureAuthURL.Error(); got != want {
+		t.Errorf("Error() = %q; want %q", got, want)
+	}
+	if fErr := err.(*ValidationError).Fields[0]; !errors.Is(fErr, errRequired) {
+		t.Errorf("errors.Is(%v, errRequired) = false; want true", fErr)
+	}
+}
+
+func TestStrictTokenSource(t *testing.T) {
+	server := newEchoServer()
+	defer server.Close()
+
+	conf := newConf(server.LoginURL)
+	conf.Strict = true
+	_, err := conf.TokenSource(context.Background(), nil).Token()
+	var vErr *ValidationError
+	if !errors.As(err, &vErr) {
+		t.Fatalf("Token error = %v; want *ValidationError", err)
+	}
+	if _, err := conf.Client(context.Background(), nil).Get(server.URL + "/resource"); !errors.As(err, &vErr) {
+		t.Errorf("Client error = %v; want *ValidationError", err)
+	}
+	if _, err := conf.KMSTokenSource(context.Background(), nil).Token(); !errors.As(err, &vErr) {
+		t.Errorf("KMSTokenSource error = %v; want *ValidationError", err)
+	}
+	if got := server.LoginCount(); got != 0 {
+		t.Errorf("LoginCount = %d; want 0", got)
+	}
+
+	conf.AllowInsecureLocalhost = true
+	if _, err := conf.TokenSource(context.Background(), nil).Token(); err != nil {
+		t.Errorf("Token with AllowInsecureLocalhost error = %v", err)
+	}
+}